@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+)
+
+// maxClientHelloPeek bounds how large a ClientHello record we're willing to
+// buffer while peeking at its SNI.  Real-world ClientHellos (even with a lot
+// of extensions) comfortably fit well under this.
+const maxClientHelloPeek = 16 * 1024
+
+var errNotHandshakeRecord = errors.New("not a TLS handshake record")
+
+// peekClientHelloSNI reads the peer's opening TLS record off conn, without
+// performing a TLS handshake, and returns the SNI found in its ClientHello
+// (empty if the extension is absent). The bytes consumed from conn to do so
+// are returned in peeked, so the caller can replay them before continuing to
+// read from conn.
+func peekClientHelloSNI(conn net.Conn) (sni string, peeked []byte, err error) {
+	hdr := make([]byte, 5) // content type (1) + version (2) + length (2)
+	if _, err := io.ReadFull(conn, hdr); err != nil {
+		return "", nil, err
+	}
+	if hdr[0] != 22 { // handshake
+		return "", hdr, errNotHandshakeRecord
+	}
+
+	recordLen := int(hdr[3])<<8 | int(hdr[4])
+	if recordLen > maxClientHelloPeek {
+		return "", hdr, errors.New("ClientHello record too large to peek")
+	}
+	body := make([]byte, recordLen)
+	n, err := io.ReadFull(conn, body)
+	if err != nil {
+		return "", append(hdr, body[:n]...), err
+	}
+	peeked = append(hdr, body...)
+
+	// handshake type (1) + length (3); we only care about ClientHello (1).
+	if len(body) < 4 || body[0] != 1 {
+		return "", peeked, nil
+	}
+	hsLen := int(body[1])<<16 | int(body[2])<<8 | int(body[3])
+	if hsLen+4 > len(body) {
+		// The ClientHello continues in a further TLS record; rather than
+		// reassembling it, give up gracefully and route on no SNI.
+		return "", peeked, nil
+	}
+
+	sni, _ = sniFromClientHello(body[4 : 4+hsLen])
+	return sni, peeked, nil
+}
+
+// sniFromClientHello extracts the host_name entry of a ClientHello's
+// server_name extension, if present.
+func sniFromClientHello(body []byte) (string, error) {
+	c := &cursor{buf: body}
+
+	if err := c.skip(2); err != nil { // client_version
+		return "", err
+	}
+	if err := c.skip(32); err != nil { // random
+		return "", err
+	}
+	sessionIDLen, err := c.uint8()
+	if err != nil {
+		return "", err
+	}
+	if err := c.skip(int(sessionIDLen)); err != nil {
+		return "", err
+	}
+
+	cipherSuitesLen, err := c.uint16()
+	if err != nil {
+		return "", err
+	}
+	if err := c.skip(int(cipherSuitesLen)); err != nil {
+		return "", err
+	}
+
+	compressionLen, err := c.uint8()
+	if err != nil {
+		return "", err
+	}
+	if err := c.skip(int(compressionLen)); err != nil {
+		return "", err
+	}
+
+	if c.remaining() == 0 {
+		return "", nil // no extensions, hence no SNI
+	}
+	extsLen, err := c.uint16()
+	if err != nil {
+		return "", err
+	}
+	extsEnd := c.pos + int(extsLen)
+	for c.pos < extsEnd {
+		extType, err := c.uint16()
+		if err != nil {
+			return "", err
+		}
+		extLen, err := c.uint16()
+		if err != nil {
+			return "", err
+		}
+		extBody, err := c.bytes(int(extLen))
+		if err != nil {
+			return "", err
+		}
+		if extType == 0 { // server_name
+			return parseServerNameList(extBody), nil
+		}
+	}
+	return "", nil
+}
+
+// parseServerNameList extracts the host_name entry of a server_name
+// extension body.
+func parseServerNameList(body []byte) string {
+	c := &cursor{buf: body}
+	listLen, err := c.uint16()
+	if err != nil {
+		return ""
+	}
+	end := c.pos + int(listLen)
+	for c.pos < end {
+		nameType, err := c.uint8()
+		if err != nil {
+			return ""
+		}
+		nameLen, err := c.uint16()
+		if err != nil {
+			return ""
+		}
+		name, err := c.bytes(int(nameLen))
+		if err != nil {
+			return ""
+		}
+		if nameType == 0 { // host_name
+			return string(name)
+		}
+	}
+	return ""
+}
+
+// cursor is a small cursor over a byte slice, used to walk the TLV-heavy
+// ClientHello structure without copying.
+type cursor struct {
+	buf []byte
+	pos int
+}
+
+func (c *cursor) remaining() int {
+	return len(c.buf) - c.pos
+}
+
+func (c *cursor) uint8() (uint8, error) {
+	if c.remaining() < 1 {
+		return 0, errNotHandshakeRecord
+	}
+	v := c.buf[c.pos]
+	c.pos++
+	return v, nil
+}
+
+func (c *cursor) uint16() (uint16, error) {
+	if c.remaining() < 2 {
+		return 0, errNotHandshakeRecord
+	}
+	v := uint16(c.buf[c.pos])<<8 | uint16(c.buf[c.pos+1])
+	c.pos += 2
+	return v, nil
+}
+
+func (c *cursor) bytes(n int) ([]byte, error) {
+	if c.remaining() < n {
+		return nil, errNotHandshakeRecord
+	}
+	b := c.buf[c.pos : c.pos+n]
+	c.pos += n
+	return b, nil
+}
+
+func (c *cursor) skip(n int) error {
+	if c.remaining() < n {
+		return errNotHandshakeRecord
+	}
+	c.pos += n
+	return nil
+}
+
+// peekedConn replays the bytes we already read off a net.Conn while peeking
+// its ClientHello, before falling through to further reads from the
+// underlying connection.
+type peekedConn struct {
+	net.Conn
+	prefix *bytes.Reader
+}
+
+func newPeekedConn(conn net.Conn, peeked []byte) *peekedConn {
+	return &peekedConn{Conn: conn, prefix: bytes.NewReader(peeked)}
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	if c.prefix.Len() > 0 {
+		return c.prefix.Read(b)
+	}
+	return c.Conn.Read(b)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// sniRule is one entry of the SNI routing config file.
+type sniRule struct {
+	// Pattern is either an exact hostname ("example.com") or a single-level
+	// wildcard ("*.example.com").
+	Pattern string `json:"pattern"`
+	// CertFile and KeyFile are the certificate to present to peers that
+	// match Pattern.
+	CertFile string `json:"cert"`
+	KeyFile  string `json:"key"`
+	// RunZeroTrace disables the zerotrace measurement for this pattern when
+	// set to false. It defaults to true, i.e. omitting the field runs
+	// zerotrace as usual.
+	RunZeroTrace *bool `json:"zerotrace,omitempty"`
+	// Upstream, if set, causes matching connections to be proxied there
+	// (after the zerotrace measurement, if any) instead of terminated
+	// locally.
+	Upstream string `json:"upstream,omitempty"`
+	// LogTag is appended to this pattern's "measurement,..." log lines, so
+	// operators can tell which front-door rule a measurement came from.
+	LogTag string `json:"log_tag,omitempty"`
+}
+
+// resolvedRule is an sniRule with its certificate already loaded.
+type resolvedRule struct {
+	pattern   string
+	tlsConfig *tls.Config
+	zeroTrace bool
+	upstream  string
+	logTag    string
+}
+
+// sniRouter picks the resolvedRule to use for a connection based on the SNI
+// it presents.
+type sniRouter struct {
+	rules []resolvedRule
+}
+
+// loadSNIRouter reads the JSON config file at path, an array of sniRule
+// objects, loading each rule's certificate up front so routing decisions at
+// connection time never hit the filesystem.
+func loadSNIRouter(path string) (*sniRouter, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading SNI config: %w", err)
+	}
+	var rules []sniRule
+	if err := json.Unmarshal(buf, &rules); err != nil {
+		return nil, fmt.Errorf("parsing SNI config: %w", err)
+	}
+
+	router := &sniRouter{rules: make([]resolvedRule, 0, len(rules))}
+	for _, r := range rules {
+		zeroTrace := true
+		if r.RunZeroTrace != nil {
+			zeroTrace = *r.RunZeroTrace
+		}
+		resolved := resolvedRule{
+			pattern:   r.Pattern,
+			zeroTrace: zeroTrace,
+			upstream:  r.Upstream,
+			logTag:    r.LogTag,
+		}
+		if r.CertFile != "" || r.KeyFile != "" {
+			cert, err := tls.LoadX509KeyPair(r.CertFile, r.KeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("loading cert for pattern %q: %w", r.Pattern, err)
+			}
+			resolved.tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		}
+		router.rules = append(router.rules, resolved)
+	}
+	return router, nil
+}
+
+// match returns the most specific rule whose pattern matches sni, where
+// specificity is approximated by pattern length: an exact match is always
+// at least as long as any wildcard that also matches it, and among
+// wildcards the one with the longer (i.e. more specific) suffix wins. It
+// returns nil if no rule matches.
+func (router *sniRouter) match(sni string) *resolvedRule {
+	var best *resolvedRule
+	bestLen := -1
+	for i := range router.rules {
+		r := &router.rules[i]
+		if !sniMatchesPattern(r.pattern, sni) {
+			continue
+		}
+		if len(r.pattern) > bestLen || (len(r.pattern) == bestLen && r.pattern == sni) {
+			best = r
+			bestLen = len(r.pattern)
+		}
+	}
+	return best
+}
+
+// sniMatchesPattern reports whether sni matches pattern, which is either an
+// exact hostname or a single-level wildcard like "*.example.com". A
+// single-level wildcard matches exactly one additional label: "*.example.com"
+// matches "a.example.com" but not "a.b.example.com".
+func sniMatchesPattern(pattern, sni string) bool {
+	if pattern == sni {
+		return true
+	}
+	suffix := strings.TrimPrefix(pattern, "*")
+	if suffix == pattern {
+		return false // pattern had no wildcard
+	}
+	if !strings.HasSuffix(sni, suffix) {
+		return false
+	}
+	label := strings.TrimSuffix(sni, suffix)
+	return label != "" && !strings.Contains(label, ".")
+}
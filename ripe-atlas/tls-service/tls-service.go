@@ -42,10 +42,13 @@ func handleConns(addr string, handle tcpHandler) {
 	}
 }
 
-// getTCPHandler returns a function that first initiates a zerotrace traceroute
-// to the peer and -- once that completes -- finishes the TLS handshake and
-// closes the connection.
-func getTCPHandler(config *tls.Config, iface string, port uint16) tcpHandler {
+// getTCPHandler returns a function that peeks the peer's SNI, resolves it
+// against router (if any) to decide which certificate to present, whether to
+// run a zerotrace traceroute at all, and whether to proxy the connection
+// upstream instead of terminating TLS locally -- and then does exactly that.
+// defaultConfig is used for peers whose SNI doesn't match any rule in
+// router, or when router is nil.
+func getTCPHandler(defaultConfig *tls.Config, router *sniRouter, iface string, port uint16) tcpHandler {
 	ztConfig := zerotrace.NewDefaultConfig()
 	ztConfig.Interface = iface
 	zt := zerotrace.NewZeroTrace(ztConfig)
@@ -56,18 +59,47 @@ func getTCPHandler(config *tls.Config, iface string, port uint16) tcpHandler {
 	return func(conn net.Conn) {
 		defer conn.Close()
 
-		// We must run the zerotrace measurement *before* the TLS handshake
-		// because Atlas probes are going to terminate the connection as soon
-		// as the fetched the server certificate.
-		l.Printf("Starting traceroute to new peer: %s", conn.RemoteAddr())
-		duration, err := zt.CalcRTT(conn)
-		if err != nil {
-			l.Printf("Error running ZeroTrace: %v", err)
+		sni, peeked, err := peekClientHelloSNI(conn)
+		if err != nil && !errors.Is(err, errNotHandshakeRecord) {
+			l.Printf("Error peeking ClientHello from %s: %v", conn.RemoteAddr(), err)
+			return
+		}
+		conn = newPeekedConn(conn, peeked)
+
+		tlsConfig := defaultConfig
+		runZeroTrace := true
+		logTag := ""
+		upstream := ""
+		if router != nil {
+			if rule := router.match(sni); rule != nil {
+				if rule.tlsConfig != nil {
+					tlsConfig = rule.tlsConfig
+				}
+				runZeroTrace = rule.zeroTrace
+				logTag = rule.logTag
+				upstream = rule.upstream
+			}
+		}
+
+		if runZeroTrace {
+			// We must run the zerotrace measurement *before* the TLS
+			// handshake because Atlas probes are going to terminate the
+			// connection as soon as the fetched the server certificate.
+			l.Printf("Starting traceroute to new peer: %s (sni=%q)", conn.RemoteAddr(), sni)
+			duration, err := zt.CalcRTT(conn)
+			if err != nil {
+				l.Printf("Error running ZeroTrace: %v", err)
+				return
+			}
+			l.Printf("measurement,%s,%d,%s,%s\n", conn.RemoteAddr(), duration.Microseconds(), sni, logTag)
+		}
+
+		if upstream != "" {
+			proxyToUpstream(conn, upstream)
 			return
 		}
-		l.Printf("measurement,%s,%d\n", conn.RemoteAddr(), duration.Microseconds())
 
-		tlsConn := tls.Server(conn, config)
+		tlsConn := tls.Server(conn, tlsConfig)
 		if err = tlsConn.Handshake(); err != nil {
 			if !errors.Is(err, io.EOF) {
 				l.Printf("Error finishing TLS handshake: %v", err)
@@ -79,19 +111,45 @@ func getTCPHandler(config *tls.Config, iface string, port uint16) tcpHandler {
 	}
 }
 
+// proxyToUpstream transparently forwards conn -- already primed with any
+// bytes peeked off it -- to the given upstream host:port, copying bytes in
+// both directions until either side closes.
+func proxyToUpstream(conn net.Conn, upstream string) {
+	up, err := net.Dial("tcp", upstream)
+	if err != nil {
+		l.Printf("Error dialing upstream %s: %v", upstream, err)
+		return
+	}
+	defer up.Close()
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(up, conn)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, up)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
 func main() {
 	var (
-		certFile string
-		keyFile  string
-		iface    string
-		addr     string
-		log      string
+		certFile  string
+		keyFile   string
+		iface     string
+		addr      string
+		log       string
+		sniConfig string
 	)
 	flag.StringVar(&certFile, "cert", "", "The TLS server's certificate file.")
 	flag.StringVar(&keyFile, "key", "", "The TLS server's key file.")
 	flag.StringVar(&iface, "iface", "", "The networking interface to use zerotrace for.")
 	flag.StringVar(&addr, "addr", "0.0.0.0:443", "The TLS server's address to listen on.")
 	flag.StringVar(&log, "log", "", "The log file to which stdout is written to.")
+	flag.StringVar(&sniConfig, "sni-config", "",
+		"Optional JSON file mapping SNI patterns to per-SNI cert, zerotrace, and upstream settings.")
 	flag.Parse()
 
 	if certFile == "" || keyFile == "" || iface == "" {
@@ -117,9 +175,18 @@ func main() {
 		Certificates: []tls.Certificate{cert},
 	}
 
+	var router *sniRouter
+	if sniConfig != "" {
+		router, err = loadSNIRouter(sniConfig)
+		if err != nil {
+			l.Fatalf("Error loading -sni-config: %v", err)
+		}
+	}
+
 	// Start accepting new TCP connections.
 	handleConns(addr, getTCPHandler(
 		tlsConfig,
+		router,
 		iface,
 		addrPort.Port(),
 	))
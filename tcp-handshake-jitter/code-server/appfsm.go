@@ -0,0 +1,249 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/reassembly"
+)
+
+const appRTTResultsFile = "results/app_rtt.csv"
+
+// appConnState accumulates the post-handshake application RTT samples for a
+// single TCP connection, identified by its four-tuple.  It's shared between
+// the connection's two appStream directions.
+type appConnState struct {
+	fsm *reassembly.TCPSimpleFSM
+
+	// serverDataAckTarget is the Ack value the client must send to
+	// acknowledge the server's first data byte; haveServerData is false
+	// until we've seen that first byte.
+	serverDataAckTarget uint32
+	serverDataTS        time.Time
+	haveServerData      bool
+	haveDataAckRTT      bool
+	dataAckRTT          time.Duration
+
+	// pendingReqTS is the timestamp of the most recent client PSH segment
+	// carrying data that we haven't yet matched with a server response.
+	pendingReqTS   time.Time
+	haveReq        bool
+	reqRespSamples []time.Duration
+
+	lastSeen time.Time
+}
+
+// appTracker holds the app-RTT state for every connection currently being
+// reassembled, keyed by four-tuple.
+type appTracker struct {
+	sync.Mutex
+	conns      map[fourTuple]*appConnState
+	fsmOpts    reassembly.TCPSimpleFSMOptions
+	nooptcheck bool
+}
+
+func newAppTracker(fsmOpts reassembly.TCPSimpleFSMOptions, nooptcheck bool) *appTracker {
+	return &appTracker{
+		conns:      make(map[fourTuple]*appConnState),
+		fsmOpts:    fsmOpts,
+		nooptcheck: nooptcheck,
+	}
+}
+
+// prune writes out and discards every connection that's been idle for longer
+// than handshakeIdleTimeout, merging in syn's three-way-handshake RTT for
+// each one.
+func (t *appTracker) prune(syn map[fourTuple]time.Duration) int {
+	t.Lock()
+	defer t.Unlock()
+
+	now := time.Now()
+	pruned := 0
+	for tuple, c := range t.conns {
+		if now.Sub(c.lastSeen) > handshakeIdleTimeout {
+			rtt, haveSyn := syn[tuple]
+			writeAppRTT(tuple, rtt, haveSyn, c)
+			delete(t.conns, tuple)
+			pruned++
+		}
+	}
+	return pruned
+}
+
+// Flush writes out and discards every connection still tracked, regardless
+// of idle time.  It's meant to be called once a pcap file has been fully
+// replayed, when there's no more live traffic left to expire them naturally.
+func (t *appTracker) Flush(syn map[fourTuple]time.Duration) int {
+	t.Lock()
+	defer t.Unlock()
+
+	flushed := len(t.conns)
+	for tuple, c := range t.conns {
+		rtt, haveSyn := syn[tuple]
+		writeAppRTT(tuple, rtt, haveSyn, c)
+	}
+	t.conns = make(map[fourTuple]*appConnState)
+	return flushed
+}
+
+// drop writes out and discards the given connection's app-RTT state, e.g.
+// because we observed a FIN or RST for it.
+func (t *appTracker) drop(tuple fourTuple, syn map[fourTuple]time.Duration) {
+	t.Lock()
+	defer t.Unlock()
+
+	c, exists := t.conns[tuple]
+	if !exists {
+		return
+	}
+	rtt, haveSyn := syn[tuple]
+	writeAppRTT(tuple, rtt, haveSyn, c)
+	delete(t.conns, tuple)
+}
+
+// appStreamFactory produces one reassembly.Stream per direction of each TCP
+// connection we reassemble.
+type appStreamFactory struct {
+	tracker *appTracker
+	port    int
+}
+
+func newAppStreamFactory(tracker *appTracker, port int) *appStreamFactory {
+	return &appStreamFactory{tracker: tracker, port: port}
+}
+
+func (f *appStreamFactory) New(net, transport gopacket.Flow, tcp *layers.TCP, ac reassembly.AssemblerContext) reassembly.Stream {
+	srcEndpoint, dstEndpoint := net.Endpoints()
+	tuple := newFourTuple(
+		srcEndpoint.Raw(), uint16(tcp.SrcPort),
+		dstEndpoint.Raw(), uint16(tcp.DstPort),
+	)
+
+	f.tracker.Lock()
+	connState, exists := f.tracker.conns[*tuple]
+	if !exists {
+		fsm := reassembly.NewTCPSimpleFSM(f.tracker.fsmOpts)
+		connState = &appConnState{fsm: fsm, lastSeen: time.Now()}
+		f.tracker.conns[*tuple] = connState
+	}
+	f.tracker.Unlock()
+
+	return &appStream{
+		tracker:        f.tracker,
+		tuple:          *tuple,
+		conn:           connState,
+		clientToServer: uint16(tcp.DstPort) == uint16(f.port),
+	}
+}
+
+// appStream implements reassembly.Stream for a single direction of a TCP
+// connection, and derives the post-handshake application RTT samples
+// described at the top of this file directly from each accepted segment.
+type appStream struct {
+	tracker        *appTracker
+	tuple          fourTuple
+	conn           *appConnState
+	clientToServer bool
+}
+
+func (s *appStream) Accept(tcp *layers.TCP, ci gopacket.CaptureInfo, dir reassembly.TCPFlowDirection, nextSeq reassembly.Sequence, start *bool, ac reassembly.AssemblerContext) bool {
+	s.tracker.Lock()
+	defer s.tracker.Unlock()
+
+	if !s.tracker.nooptcheck && tcp.RST {
+		return false
+	}
+	if !s.conn.fsm.CheckState(tcp, dir) {
+		return false
+	}
+	s.conn.lastSeen = ci.Timestamp
+	s.observe(tcp, dir, ci.Timestamp)
+
+	*start = true
+	return true
+}
+
+// observe updates the connection's app-RTT state from a single accepted TCP
+// segment.  Must be called with s.tracker locked.
+func (s *appStream) observe(tcp *layers.TCP, dir reassembly.TCPFlowDirection, ts time.Time) {
+	payloadLen := len(tcp.Payload)
+
+	if dir == reassembly.TCPDirServerToClient && payloadLen > 0 && !s.conn.haveServerData {
+		s.conn.haveServerData = true
+		s.conn.serverDataTS = ts
+		s.conn.serverDataAckTarget = tcp.Seq + uint32(payloadLen)
+	}
+	if dir == reassembly.TCPDirClientToServer && s.conn.haveServerData && !s.conn.haveDataAckRTT &&
+		tcp.ACK && tcp.Ack == s.conn.serverDataAckTarget {
+		s.conn.haveDataAckRTT = true
+		s.conn.dataAckRTT = ts.Sub(s.conn.serverDataTS)
+	}
+
+	if payloadLen == 0 || !tcp.PSH {
+		return
+	}
+	switch dir {
+	case reassembly.TCPDirClientToServer:
+		s.conn.pendingReqTS = ts
+		s.conn.haveReq = true
+	case reassembly.TCPDirServerToClient:
+		if s.conn.haveReq {
+			s.conn.reqRespSamples = append(s.conn.reqRespSamples, ts.Sub(s.conn.pendingReqTS))
+			s.conn.haveReq = false
+		}
+	}
+}
+
+// ReassembledSG doesn't need to inspect the reassembled data itself: the
+// PSH/ACK bookkeeping we care about already happened in Accept, which sees
+// every segment (including pure ACKs that never show up here).
+func (s *appStream) ReassembledSG(sg reassembly.ScatterGather, ac reassembly.AssemblerContext) {
+	sg.KeepFrom(0)
+}
+
+func (s *appStream) ReassemblyComplete(ac reassembly.AssemblerContext) bool {
+	return true
+}
+
+// medianDuration returns the median of ds, or zero if ds is empty.
+func medianDuration(ds []time.Duration) time.Duration {
+	if len(ds) == 0 {
+		return 0
+	}
+	sorted := append([]time.Duration(nil), ds...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[len(sorted)/2]
+}
+
+// writeAppRTT appends one row to results/app_rtt.csv: the four-tuple, the
+// three-way-handshake RTT (if known), the server-data-to-client-ACK RTT (if
+// observed), and the median of the connection's request/response samples.
+func writeAppRTT(tuple fourTuple, synRTT time.Duration, haveSyn bool, c *appConnState) {
+	if err := os.MkdirAll("results", 0755); err != nil {
+		log.Printf("Failed to create results directory: %v", err)
+		return
+	}
+	fd, err := os.OpenFile(appRTTResultsFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Printf("Failed to open %s: %v", appRTTResultsFile, err)
+		return
+	}
+	defer fd.Close()
+
+	var synUs, dataAckUs int64
+	if haveSyn {
+		synUs = synRTT.Microseconds()
+	}
+	if c.haveDataAckRTT {
+		dataAckUs = c.dataAckRTT.Microseconds()
+	}
+	fmt.Fprintf(fd, "%s, %d, %d, %d, %d\n",
+		tuple.String(), synUs, dataAckUs, medianDuration(c.reqRespSamples).Microseconds(), len(c.reqRespSamples))
+	log.Printf("Wrote app RTT sample for %s to %s", tuple.String(), appRTTResultsFile)
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	dirClientToServer = 0
+	dirServerToClient = 1
+
+	// flowIdleTimeout is how long a flow can go without a packet before
+	// flowTracker gives up on it.  It's longer than handshakeIdleTimeout
+	// because, unlike the handshake, a flow is expected to go quiet between
+	// WebSocket messages.
+	flowIdleTimeout = 60 * time.Second
+
+	flowResultsFile = "results/flow_rtt.csv"
+)
+
+// pendingSegment is a data segment we've seen but not yet seen acknowledged.
+type pendingSegment struct {
+	sentAt time.Time
+	seq    uint32
+}
+
+// flowState is modeled on gopacket's examples/bidirectional: it keeps both
+// half-flows of a connection alive for the connection's lifetime (not just
+// through the handshake) so we can keep sampling RTT from ordinary
+// traffic, not just the initial SYN/SYN-ACK/ACK.
+type flowState struct {
+	tuple fourTuple
+
+	// pending[dir] holds, for data segments sent in direction dir, the
+	// send timestamp keyed by the ACK number (seq+len) that would
+	// acknowledge them.
+	pending [2]map[uint32]pendingSegment
+	// seen[dir] remembers the seq of every data segment sent in direction
+	// dir that's still awaiting its ACK, so a repeated seq (a
+	// retransmission) can be recognized and excluded from sampling instead
+	// of silently reusing a stale pending entry. Entries are removed as
+	// soon as the segment is ACKed (alongside the matching pending entry),
+	// which bounds seen's size to the connection's current in-flight
+	// segments rather than letting it grow for the connection's whole
+	// lifetime.
+	seen [2]map[uint32]bool
+
+	min      time.Duration
+	smoothed time.Duration
+	jitter   time.Duration
+	nSamples int
+	lastSeen time.Time
+}
+
+func newFlowState(tuple fourTuple, now time.Time) *flowState {
+	return &flowState{
+		tuple:    tuple,
+		pending:  [2]map[uint32]pendingSegment{make(map[uint32]pendingSegment), make(map[uint32]pendingSegment)},
+		seen:     [2]map[uint32]bool{make(map[uint32]bool), make(map[uint32]bool)},
+		lastSeen: now,
+	}
+}
+
+// sample folds a newly matched RTT into the flow's rolling min, smoothed
+// average, and jitter estimate, using the same smoothing factors as TCP's
+// own RTT estimator (RFC 6298) and jitter estimator (RFC 3550, section
+// A.8).
+func (f *flowState) sample(rtt time.Duration) {
+	f.nSamples++
+	if f.min == 0 || rtt < f.min {
+		f.min = rtt
+	}
+	if f.smoothed == 0 {
+		f.smoothed = rtt
+		f.jitter = 0
+		return
+	}
+	delta := rtt - f.smoothed
+	if delta < 0 {
+		delta = -delta
+	}
+	f.smoothed += (rtt - f.smoothed) / 8
+	f.jitter += (delta - f.jitter) / 16
+}
+
+// flowTracker samples RTT across the full lifetime of every accepted
+// connection, by matching outgoing segments against the ACKs that
+// eventually acknowledge them, rather than only looking at the TCP
+// handshake like stateMachine does.
+type flowTracker struct {
+	sync.RWMutex
+	srvPort int
+	m       map[fourTuple]*flowState
+}
+
+func newFlowTracker(srvPort int) *flowTracker {
+	return &flowTracker{srvPort: srvPort, m: make(map[fourTuple]*flowState)}
+}
+
+// prune writes out and discards every flow that's been idle for longer than
+// flowIdleTimeout.  Each flow is written exactly once, here or in add (on
+// FIN/RST) or in Flush -- never per sample -- since the result row is a
+// per-connection rolling summary, not a per-packet log.
+func (f *flowTracker) prune() int {
+	f.Lock()
+	defer f.Unlock()
+
+	now := time.Now()
+	deleted := 0
+	for tuple, state := range f.m {
+		if now.Sub(state.lastSeen) > flowIdleTimeout {
+			writeFlowSample(state)
+			delete(f.m, tuple)
+			deleted++
+		}
+	}
+	return deleted
+}
+
+// Flush writes out and discards every flow still tracked, regardless of idle
+// time.  It's meant to be called once a pcap file has been fully replayed,
+// when there's no more live traffic left to expire them naturally.
+func (f *flowTracker) Flush() int {
+	f.Lock()
+	defer f.Unlock()
+
+	flushed := len(f.m)
+	for _, state := range f.m {
+		writeFlowSample(state)
+	}
+	f.m = make(map[fourTuple]*flowState)
+	return flushed
+}
+
+// add feeds one packet into the tracker.  It's a no-op for anything but TCP
+// segments that belong to a connection on f.srvPort.
+func (f *flowTracker) add(p gopacket.Packet) {
+	tcp, ok := p.Layer(layers.LayerTypeTCP).(*layers.TCP)
+	if !ok {
+		return
+	}
+	if uint16(tcp.SrcPort) != uint16(f.srvPort) && uint16(tcp.DstPort) != uint16(f.srvPort) {
+		return
+	}
+	tuple, err := pktToTuple(p)
+	if err != nil {
+		return
+	}
+	ts := p.Metadata().Timestamp
+
+	f.Lock()
+	defer f.Unlock()
+
+	if tcp.FIN || tcp.RST {
+		if state, exists := f.m[*tuple]; exists {
+			writeFlowSample(state)
+			delete(f.m, *tuple)
+		}
+		return
+	}
+
+	state, exists := f.m[*tuple]
+	if !exists {
+		state = newFlowState(*tuple, ts)
+		f.m[*tuple] = state
+	}
+	state.lastSeen = ts
+
+	dir := dirServerToClient
+	if uint16(tcp.DstPort) == uint16(f.srvPort) {
+		dir = dirClientToServer
+	}
+	reverse := 1 - dir
+
+	if payloadLen := len(tcp.LayerPayload()); payloadLen > 0 {
+		ackKey := tcp.Seq + uint32(payloadLen)
+		if state.seen[dir][tcp.Seq] {
+			// A retransmission: the pending entry we recorded for the
+			// first transmission no longer reflects this segment's true
+			// send time, so drop it instead of sampling against it. Clear
+			// seen too -- its matching pending entry is gone, so the ACK
+			// that would otherwise clear it will never arrive.
+			delete(state.pending[dir], ackKey)
+			delete(state.seen[dir], tcp.Seq)
+		} else {
+			state.seen[dir][tcp.Seq] = true
+			state.pending[dir][ackKey] = pendingSegment{sentAt: ts, seq: tcp.Seq}
+		}
+	}
+
+	if tcp.ACK {
+		if seg, ok := state.pending[reverse][tcp.Ack]; ok {
+			delete(state.pending[reverse], tcp.Ack)
+			delete(state.seen[reverse], seg.seq)
+			state.sample(ts.Sub(seg.sentAt))
+		}
+	}
+}
+
+// writeFlowSample appends the flow's current rolling min/smoothed/jitter
+// RTT tuple to results/flow_rtt.csv.
+func writeFlowSample(s *flowState) {
+	if err := os.MkdirAll("results", 0755); err != nil {
+		log.Printf("Failed to create results directory: %v", err)
+		return
+	}
+	fd, err := os.OpenFile(flowResultsFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Printf("Failed to open %s: %v", flowResultsFile, err)
+		return
+	}
+	defer fd.Close()
+
+	fmt.Fprintf(fd, "%s, %s, %d, %d, %d, %d\n",
+		s.tuple.srcAddr, s.tuple.dstAddr, s.nSamples,
+		s.min.Microseconds(), s.smoothed.Microseconds(), s.jitter.Microseconds())
+}
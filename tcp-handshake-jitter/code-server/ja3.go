@@ -0,0 +1,346 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+const (
+	tlsHandshakeTypeClientHello = 1
+	tlsHandshakeTypeServerHello = 2
+
+	tlsExtensionServerName    = 0
+	tlsExtensionSupportedGrp  = 10
+	tlsExtensionECPointFormat = 11
+)
+
+var errMalformedHello = errors.New("malformed TLS hello message")
+
+// Fingerprinting only ever runs once tlsStream.ReassembledSG (tlsrtt.go)
+// actually feeds both directions' record parsers -- client bytes to
+// s.conn.client, server bytes to s.conn.server -- which is what drives
+// recordHello to call ja3/ja3s below.
+
+// isGREASE reports whether v is one of TLS's reserved GREASE values
+// (RFC 8701), which JA3 excludes from its fingerprint since they're
+// intentionally randomized by some clients and would otherwise make every
+// fingerprint unique.
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// clientHello holds the handful of ClientHello fields JA3 fingerprints.
+type clientHello struct {
+	version      uint16
+	cipherSuites []uint16
+	extensions   []uint16
+	curves       []uint16
+	pointFormats []uint16
+	sni          string
+}
+
+// serverHello holds the handful of ServerHello fields JA3S fingerprints.
+type serverHello struct {
+	version    uint16
+	cipher     uint16
+	extensions []uint16
+}
+
+// parseClientHello walks the body of a ClientHello handshake message (i.e.
+// everything after the 4-byte handshake header) far enough to extract the
+// fields JA3 needs.
+func parseClientHello(body []byte) (*clientHello, error) {
+	r := &byteReader{buf: body}
+
+	version, err := r.uint16()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.skip(32); err != nil { // random
+		return nil, err
+	}
+	sessionIDLen, err := r.uint8()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.skip(int(sessionIDLen)); err != nil {
+		return nil, err
+	}
+
+	cipherSuitesLen, err := r.uint16()
+	if err != nil {
+		return nil, err
+	}
+	cipherSuites, err := r.uint16Slice(int(cipherSuitesLen) / 2)
+	if err != nil {
+		return nil, err
+	}
+
+	compressionLen, err := r.uint8()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.skip(int(compressionLen)); err != nil {
+		return nil, err
+	}
+
+	ch := &clientHello{version: version, cipherSuites: cipherSuites}
+
+	// Extensions are optional: a ClientHello with nothing left to read
+	// simply has none.
+	if r.remaining() == 0 {
+		return ch, nil
+	}
+	extsLen, err := r.uint16()
+	if err != nil {
+		return nil, err
+	}
+	extsEnd := r.pos + int(extsLen)
+	for r.pos < extsEnd {
+		extType, err := r.uint16()
+		if err != nil {
+			return nil, err
+		}
+		extLen, err := r.uint16()
+		if err != nil {
+			return nil, err
+		}
+		extBody, err := r.bytes(int(extLen))
+		if err != nil {
+			return nil, err
+		}
+		ch.extensions = append(ch.extensions, extType)
+
+		switch extType {
+		case tlsExtensionServerName:
+			ch.sni = parseSNI(extBody)
+		case tlsExtensionSupportedGrp:
+			ch.curves = parseUint16List(extBody)
+		case tlsExtensionECPointFormat:
+			ch.pointFormats = parseUint8List(extBody)
+		}
+	}
+	return ch, nil
+}
+
+// parseServerHello walks the body of a ServerHello handshake message far
+// enough to extract the fields JA3S needs.
+func parseServerHello(body []byte) (*serverHello, error) {
+	r := &byteReader{buf: body}
+
+	version, err := r.uint16()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.skip(32); err != nil { // random
+		return nil, err
+	}
+	sessionIDLen, err := r.uint8()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.skip(int(sessionIDLen)); err != nil {
+		return nil, err
+	}
+	cipher, err := r.uint16()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.skip(1); err != nil { // compression method
+		return nil, err
+	}
+
+	sh := &serverHello{version: version, cipher: cipher}
+
+	if r.remaining() == 0 {
+		return sh, nil
+	}
+	extsLen, err := r.uint16()
+	if err != nil {
+		return nil, err
+	}
+	extsEnd := r.pos + int(extsLen)
+	for r.pos < extsEnd {
+		extType, err := r.uint16()
+		if err != nil {
+			return nil, err
+		}
+		extLen, err := r.uint16()
+		if err != nil {
+			return nil, err
+		}
+		if err := r.skip(int(extLen)); err != nil {
+			return nil, err
+		}
+		sh.extensions = append(sh.extensions, extType)
+	}
+	return sh, nil
+}
+
+// parseSNI extracts the host_name entry of a server_name extension body.
+func parseSNI(body []byte) string {
+	r := &byteReader{buf: body}
+	listLen, err := r.uint16()
+	if err != nil {
+		return ""
+	}
+	end := r.pos + int(listLen)
+	for r.pos < end {
+		nameType, err := r.uint8()
+		if err != nil {
+			return ""
+		}
+		nameLen, err := r.uint16()
+		if err != nil {
+			return ""
+		}
+		name, err := r.bytes(int(nameLen))
+		if err != nil {
+			return ""
+		}
+		if nameType == 0 { // host_name
+			return string(name)
+		}
+	}
+	return ""
+}
+
+func parseUint16List(body []byte) []uint16 {
+	r := &byteReader{buf: body}
+	listLen, err := r.uint16()
+	if err != nil {
+		return nil
+	}
+	vals, err := r.uint16Slice(int(listLen) / 2)
+	if err != nil {
+		return nil
+	}
+	return vals
+}
+
+func parseUint8List(body []byte) []uint16 {
+	r := &byteReader{buf: body}
+	listLen, err := r.uint8()
+	if err != nil {
+		return nil
+	}
+	var vals []uint16
+	for i := 0; i < int(listLen); i++ {
+		v, err := r.uint8()
+		if err != nil {
+			break
+		}
+		vals = append(vals, uint16(v))
+	}
+	return vals
+}
+
+// ja3 builds the JA3 string and its MD5 hash for a ClientHello:
+// "SSLVersion,Cipher,Extension,EllipticCurve,EllipticCurvePointFormat",
+// skipping GREASE values throughout.
+func ja3(ch *clientHello) (string, string) {
+	s := strings.Join([]string{
+		strconv.Itoa(int(ch.version)),
+		joinUint16(filterGREASE(ch.cipherSuites)),
+		joinUint16(filterGREASE(ch.extensions)),
+		joinUint16(filterGREASE(ch.curves)),
+		joinUint16(ch.pointFormats),
+	}, ",")
+	return s, hashHex(s)
+}
+
+// ja3s builds the JA3S string and its MD5 hash for a ServerHello:
+// "SSLVersion,Cipher,Extension".
+func ja3s(sh *serverHello) (string, string) {
+	s := strings.Join([]string{
+		strconv.Itoa(int(sh.version)),
+		strconv.Itoa(int(sh.cipher)),
+		joinUint16(sh.extensions),
+	}, ",")
+	return s, hashHex(s)
+}
+
+func filterGREASE(vs []uint16) []uint16 {
+	var out []uint16
+	for _, v := range vs {
+		if !isGREASE(v) {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func joinUint16(vs []uint16) string {
+	parts := make([]string, len(vs))
+	for i, v := range vs {
+		parts[i] = strconv.Itoa(int(v))
+	}
+	return strings.Join(parts, "-")
+}
+
+func hashHex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// byteReader is a small cursor over a byte slice, used to walk the
+// TLV-heavy ClientHello/ServerHello structures without copying.
+type byteReader struct {
+	buf []byte
+	pos int
+}
+
+func (r *byteReader) remaining() int {
+	return len(r.buf) - r.pos
+}
+
+func (r *byteReader) uint8() (uint8, error) {
+	if r.remaining() < 1 {
+		return 0, errMalformedHello
+	}
+	v := r.buf[r.pos]
+	r.pos++
+	return v, nil
+}
+
+func (r *byteReader) uint16() (uint16, error) {
+	if r.remaining() < 2 {
+		return 0, errMalformedHello
+	}
+	v := binary.BigEndian.Uint16(r.buf[r.pos:])
+	r.pos += 2
+	return v, nil
+}
+
+func (r *byteReader) uint16Slice(n int) ([]uint16, error) {
+	vals := make([]uint16, n)
+	for i := 0; i < n; i++ {
+		v, err := r.uint16()
+		if err != nil {
+			return nil, err
+		}
+		vals[i] = v
+	}
+	return vals, nil
+}
+
+func (r *byteReader) bytes(n int) ([]byte, error) {
+	if r.remaining() < n {
+		return nil, errMalformedHello
+	}
+	b := r.buf[r.pos : r.pos+n]
+	r.pos += n
+	return b, nil
+}
+
+func (r *byteReader) skip(n int) error {
+	if r.remaining() < n {
+		return errMalformedHello
+	}
+	r.pos += n
+	return nil
+}
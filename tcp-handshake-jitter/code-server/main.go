@@ -9,10 +9,13 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"time"
 
 	"github.com/google/gopacket"
+	"github.com/google/gopacket/ip4defrag"
 	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcap"
+	"github.com/google/gopacket/reassembly"
 )
 
 var (
@@ -25,39 +28,52 @@ var (
 	errNoIPPkt             = errors.New("not an IPv4 or IPv6 packet")
 )
 
-// filter returns the pcap filter that we use to capture TCP handshakes for the
-// given port.
-func filter(port int) string {
-	return fmt.Sprintf("tcp[tcpflags] == tcp-syn or "+
-		"tcp[tcpflags] == tcp-ack or "+
-		"tcp[tcpflags] == tcp-syn|tcp-ack and "+
-		"port %d", port)
+// filter returns the pcap filter that we use to capture traffic for the given
+// port.  It's deliberately broad -- not just the handshake segments -- so
+// that the app-RTT tracker can observe post-handshake data and ACKs too.
+// Unless nodefrag is set, it also admits IPv4 fragments other than the
+// first: those continuation fragments carry no TCP header (so "port N"
+// never matches them), but defragIPv4 still needs to see them to
+// reassemble a fragmented handshake. The extra traffic this pulls in is
+// filtered back out once defragIPv4 reassembles each datagram and
+// processPkts re-checks for a TCP layer.
+func filter(port int, nodefrag bool) string {
+	tcpFilter := fmt.Sprintf("tcp and port %d", port)
+	if nodefrag {
+		return tcpFilter
+	}
+	return fmt.Sprintf("(%s) or (ip[6:2] & 0x1fff != 0)", tcpFilter)
 }
 
 // pktToTuple extracts the four-tuple from the given packet: source IP address,
-// source port, destination IP address, destination port.
+// source port, destination IP address, destination port.  It walks every
+// decoded layer rather than trusting p.NetworkLayer(), because that only
+// returns the outermost network layer -- on a VLAN trunk or an IP-in-GRE
+// tunnel, the IPv4/IPv6 header we actually want to key on (the one carrying
+// the TCP segment) sits behind a Dot1Q, MPLS, or GRE layer instead.
 func pktToTuple(p gopacket.Packet) (*fourTuple, error) {
 	var srcAddr, dstAddr net.IP
+	var protocol layers.IPProtocol
+	foundIP := false
 
-	// Are we dealing with IPv4 or IPv6?
-	if p.NetworkLayer().LayerType() == layers.LayerTypeIPv4 {
-		v4 := p.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
-		srcAddr = v4.SrcIP
-		dstAddr = v4.DstIP
-		if v4.Protocol != layers.IPProtocolTCP {
-			return nil, errIPHasNoTCP
-		}
-	} else if p.NetworkLayer().LayerType() == layers.LayerTypeIPv6 {
-		// IPv6
-		v6 := p.Layer(layers.LayerTypeIPv6).(*layers.IPv6)
-		srcAddr = v6.SrcIP
-		dstAddr = v6.DstIP
-		if v6.NextHeader != layers.IPProtocolTCP {
-			return nil, errIPHasNoTCP
+	for _, l := range p.Layers() {
+		switch v := l.(type) {
+		case *layers.IPv4:
+			srcAddr, dstAddr = v.SrcIP, v.DstIP
+			protocol = v.Protocol
+			foundIP = true
+		case *layers.IPv6:
+			srcAddr, dstAddr = v.SrcIP, v.DstIP
+			protocol = v.NextHeader
+			foundIP = true
 		}
-	} else {
+	}
+	if !foundIP {
 		return nil, errNoIPPkt
 	}
+	if protocol != layers.IPProtocolTCP {
+		return nil, errIPHasNoTCP
+	}
 
 	tcp := p.Layer(layers.LayerTypeTCP).(*layers.TCP)
 	return newFourTuple(
@@ -125,28 +141,108 @@ func pktsShareHandshake(p1, p2 gopacket.Packet) bool {
 	return t1.Seq == (t2.Ack - 1)
 }
 
-func processPkts(handle *pcap.Handle, s *stateMachine) {
+// defragIPv4 reassembles fragmented IPv4 packets before the rest of the
+// pipeline ever sees them, using defragger to hold in-progress fragments.  It
+// returns false if packet should be skipped, either because it's a fragment
+// we're still waiting on, or because defragger rejected it.
+func defragIPv4(packet gopacket.Packet, defragger *ip4defrag.IPv4Defragmenter) bool {
+	ip4Layer := packet.Layer(layers.LayerTypeIPv4)
+	if ip4Layer == nil {
+		return true
+	}
+	ip4 := ip4Layer.(*layers.IPv4)
+	length := ip4.Length
+
+	newip4, err := defragger.DefragIPv4(ip4)
+	if err != nil {
+		log.Printf("Error defragmenting IPv4 packet: %v", err)
+		return false
+	} else if newip4 == nil {
+		return false // Fragment; we're still waiting on the rest.
+	}
+	if newip4.Length != length {
+		pb, ok := packet.(gopacket.PacketBuilder)
+		if ok {
+			nextDecoder := newip4.NextLayerType()
+			if err := nextDecoder.Decode(newip4.Payload, pb); err != nil {
+				log.Printf("Error decoding reassembled IPv4 payload: %v", err)
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// processPkts feeds every packet from handle into the handshake RTT state
+// machine and, in parallel, into the TLS RTT assembler and the bidirectional
+// flow RTT tracker.
+func processPkts(handle *pcap.Handle, s *stateMachine, tlsTracker *tlsTracker, assembler *reassembly.Assembler, flows *flowTracker, appTrack *appTracker, appAssembler *reassembly.Assembler, defragger *ip4defrag.IPv4Defragmenter, nodefrag bool) {
 	log.Println("Beginning pcap packet processing loop.")
 	packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
 	for packet := range packetSource.Packets() {
+		if !nodefrag && !defragIPv4(packet, defragger) {
+			continue
+		}
+
 		_ = s.add(packet)
+
+		if pruned := tlsTracker.prune(); pruned > 0 {
+			log.Printf("Pruned %d idle TLS streams; %d remaining", pruned, len(tlsTracker.conns))
+		}
+		if pruned := flows.prune(); pruned > 0 {
+			log.Printf("Pruned %d idle flows; %d remaining", pruned, len(flows.m))
+		}
+		if pruned := appTrack.prune(s.synRTTs()); pruned > 0 {
+			log.Printf("Pruned %d idle app-RTT streams; %d remaining", pruned, len(appTrack.conns))
+		}
+		if !nodefrag {
+			if discarded := defragger.DiscardOlderThan(time.Now().Add(-handshakeIdleTimeout)); discarded > 0 {
+				log.Printf("Discarded %d stale IPv4 fragments", discarded)
+			}
+		}
+
+		tcpLayer := packet.Layer(layers.LayerTypeTCP)
+		if tcpLayer == nil || packet.NetworkLayer() == nil {
+			continue
+		}
+		tcp := tcpLayer.(*layers.TCP)
+		flows.add(packet)
+		if tcp.FIN || tcp.RST {
+			if tuple, err := pktToTuple(packet); err == nil {
+				tlsTracker.drop(*tuple)
+				appTrack.drop(*tuple, s.synRTTs())
+			}
+			continue
+		}
+		ctx := &packetContext{ci: packet.Metadata().CaptureInfo}
+		assembler.AssembleWithContext(packet.NetworkLayer().NetworkFlow(), tcp, ctx)
+		appAssembler.AssembleWithContext(packet.NetworkLayer().NetworkFlow(), tcp, ctx)
 	}
 }
 
-func writeToFile(s *stateMachine) {
+const rttResultsFile = "results/handshake_rtt.csv"
+
+// dumpRTTs appends the accumulated handshake RTTs to results/handshake_rtt.csv,
+// using the same fields (timestamp, source, destination, RTT in
+// microseconds) as the WebSocket RTT writer in the webserver tool.
+func dumpRTTs(s *stateMachine) {
 	s.RLock()
-	defer s.RLock()
+	defer s.RUnlock()
 
-	fd, err := os.CreateTemp(".", "rtts-")
+	if err := os.MkdirAll("results", 0755); err != nil {
+		log.Fatalf("Failed to create results directory: %v", err)
+	}
+	fd, err := os.OpenFile(rttResultsFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
-		log.Fatal(err)
+		log.Fatalf("Failed to open %s: %v", rttResultsFile, err)
 	}
+	defer fd.Close()
 
-	fmt.Fprintln(fd, "us")
-	for _, rtt := range s.rtts {
-		fmt.Fprintln(fd, rtt.Microseconds())
+	for _, sample := range s.rtts {
+		fmt.Fprintf(fd, "%d, %s, %s, %d\n",
+			time.Now().Unix(), sample.tuple.srcAddr, sample.tuple.dstAddr, sample.rtt.Microseconds())
 	}
-	log.Printf("Wrote %d RTTs to: %s", len(s.rtts), fd.Name())
+	log.Printf("Wrote %d RTTs to: %s", len(s.rtts), rttResultsFile)
 }
 
 func startWebServer(port int) {
@@ -161,7 +257,13 @@ func startWebServer(port int) {
 func main() {
 	var srvPort int
 	var iface string
+	var pcapFile string
+	var probeTargets string
+	var probeReps int
+	var probeInterval time.Duration
 	var runSrv, clientSide bool
+	var nodefrag, nooptcheck, allowmissinginit bool
+	var supportMissingEstablishment bool
 
 	flag.BoolVar(&runSrv, "run-server", false,
 		"Spin up Web server to facilitate measurements")
@@ -169,10 +271,35 @@ func main() {
 		"This program runs on the side of the initiator of the TCP handshake")
 	flag.StringVar(&iface, "iface", "eth0",
 		"Networking interface to monitor")
+	flag.StringVar(&pcapFile, "pcap", "",
+		"Replay handshakes from this pcap file instead of capturing live traffic")
+	flag.StringVar(&probeTargets, "probe", "",
+		"Comma-separated host:port targets to actively SYN-probe, instead of monitoring for handshakes")
+	flag.IntVar(&probeReps, "probe-reps", 3,
+		"Number of SYN probes to send to each -probe target")
+	flag.DurationVar(&probeInterval, "probe-interval", 200*time.Millisecond,
+		"Interval to wait between SYN probes")
 	flag.IntVar(&srvPort, "port", 443,
 		"Port to monitor for TCP handshakes")
+	flag.BoolVar(&nodefrag, "nodefrag", false,
+		"Disable IPv4 defragmentation before TLS reassembly")
+	flag.BoolVar(&nooptcheck, "nooptcheck", false,
+		"Accept RST segments during TLS and app-RTT reassembly instead of rejecting them (TCP options are not checked either way)")
+	flag.BoolVar(&allowmissinginit, "allowmissinginit", false,
+		"Start reassembling a TLS connection even if its initial SYN was missed")
+	flag.BoolVar(&supportMissingEstablishment, "support-missing-establishment", false,
+		"Let the app-RTT tracker pick up TCP connections whose handshake wasn't captured")
 	flag.Parse()
 
+	if probeTargets != "" {
+		targets, err := parseProbeTargets(probeTargets)
+		if err != nil {
+			log.Fatalf("Invalid -probe targets: %v", err)
+		}
+		runProbeMode(targets, probeReps, probeInterval)
+		return
+	}
+
 	if runSrv {
 		go startWebServer(srvPort)
 	}
@@ -181,21 +308,64 @@ func main() {
 		m:          make(map[fourTuple]*handshake),
 	}
 
-	// Upon receiving ctrl+c, we write our data to a file and exit.
+	// Upon receiving ctrl+c, we write our data to a file and exit.  This only
+	// matters for live capture; pcap replay finishes on its own below.
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
 	go func() {
 		<-c
-		writeToFile(state)
+		dumpRTTs(state)
 		os.Exit(0)
 	}()
 
-	handle, err := pcap.OpenLive(iface, 1600, true, pcap.BlockForever)
-	if err != nil {
-		log.Fatalf("Failed to create pcap handle: %v", err)
+	var handle *pcap.Handle
+	var err error
+	if pcapFile != "" {
+		handle, err = pcap.OpenOffline(pcapFile)
+		if err != nil {
+			log.Fatalf("Failed to open pcap file %s: %v", pcapFile, err)
+		}
+	} else {
+		handle, err = pcap.OpenLive(iface, 1600, true, pcap.BlockForever)
+		if err != nil {
+			log.Fatalf("Failed to create pcap handle: %v", err)
+		}
 	}
-	if err = handle.SetBPFFilter(filter(srvPort)); err != nil {
+	if err = handle.SetBPFFilter(filter(srvPort, nodefrag)); err != nil {
 		log.Fatalf("Failed to set pcap filter: %v", err)
 	}
-	processPkts(handle, state)
+
+	tlsTracker := newTLSTracker()
+	tlsFactory := newTLSStreamFactory(tlsTracker, tlsStreamOpts{
+		nodefrag:         nodefrag,
+		nooptcheck:       nooptcheck,
+		allowmissinginit: allowmissinginit,
+	})
+	assembler := reassembly.NewAssembler(reassembly.NewStreamPool(tlsFactory))
+	flows := newFlowTracker(srvPort)
+
+	appTrack := newAppTracker(reassembly.TCPSimpleFSMOptions{
+		SupportMissingEstablishment: supportMissingEstablishment,
+	}, nooptcheck)
+	appFactory := newAppStreamFactory(appTrack, srvPort)
+	appAssembler := reassembly.NewAssembler(reassembly.NewStreamPool(appFactory))
+
+	defragger := ip4defrag.NewIPv4Defragmenter()
+
+	processPkts(handle, state, tlsTracker, assembler, flows, appTrack, appAssembler, defragger, nodefrag)
+
+	// processPkts only returns once the packet source is exhausted, which
+	// happens for pcap replay but never for live capture.
+	if pcapFile != "" {
+		if discarded := state.Flush(); discarded > 0 {
+			log.Printf("Flushed %d partial handshakes after replay.", discarded)
+		}
+		if flushed := appTrack.Flush(state.synRTTs()); flushed > 0 {
+			log.Printf("Flushed %d app-RTT streams after replay.", flushed)
+		}
+		if flushed := flows.Flush(); flushed > 0 {
+			log.Printf("Flushed %d flows after replay.", flushed)
+		}
+		dumpRTTs(state)
+	}
 }
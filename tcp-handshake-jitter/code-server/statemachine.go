@@ -8,11 +8,25 @@ import (
 	"github.com/google/gopacket"
 )
 
+// handshakeIdleTimeout is how long we wait for a TCP connection's remaining
+// handshake segments before giving up on it.  Other subsystems that track
+// per-connection state (e.g. the TLS RTT tracker) reuse this value so that
+// they all expire state at the same pace.
+const handshakeIdleTimeout = 30 * time.Second
+
+// rttSample pairs a measured handshake RTT with the four-tuple it belongs to,
+// so we can later dump it alongside the fields used by the other RTT writers
+// in this repo.
+type rttSample struct {
+	tuple fourTuple
+	rtt   time.Duration
+}
+
 type stateMachine struct {
 	sync.RWMutex
 	clientSide bool
 	m          map[fourTuple]*handshake
-	rtts       []time.Duration
+	rtts       []rttSample
 }
 
 func (s *stateMachine) prune() int {
@@ -22,10 +36,10 @@ func (s *stateMachine) prune() int {
 	now := time.Now()
 	deleted := 0
 	for t, connState := range s.m {
-		// Consider a TCP connection timed out after 30 seconds.  Note
-		// that it's fine to be strict here because we only care about
-		// the TCP handshake.  Subsequent data packets don't matter.
-		if now.Sub(connState.lastPkt) > (30 * time.Second) {
+		// Consider a TCP connection timed out after handshakeIdleTimeout.
+		// Note that it's fine to be strict here because we only care
+		// about the TCP handshake.  Subsequent data packets don't matter.
+		if now.Sub(connState.lastPkt) > handshakeIdleTimeout {
 			delete(s.m, t)
 			deleted += 1
 		}
@@ -104,8 +118,12 @@ func (s *stateMachine) add(p gopacket.Packet) error {
 		if err != nil {
 			log.Printf("Failed to determine RTT of completed handshake: %v", err)
 		} else {
+			tuple, err := pktToTuple(p)
+			if err != nil {
+				return errNoFourTuple
+			}
 			s.Lock()
-			s.rtts = append(s.rtts, rtt)
+			s.rtts = append(s.rtts, rttSample{tuple: *tuple, rtt: rtt})
 			s.Unlock()
 			_ = s.deleteStateForPkt(p)
 		}
@@ -114,6 +132,33 @@ func (s *stateMachine) add(p gopacket.Packet) error {
 	return nil
 }
 
+// synRTTs snapshots the three-way-handshake RTT measured for every four-tuple
+// seen so far, keyed by four-tuple, for subsystems (e.g. the app-layer RTT
+// tracker) that want to report it alongside their own per-connection samples.
+func (s *stateMachine) synRTTs() map[fourTuple]time.Duration {
+	s.RLock()
+	defer s.RUnlock()
+
+	rtts := make(map[fourTuple]time.Duration, len(s.rtts))
+	for _, sample := range s.rtts {
+		rtts[sample.tuple] = sample.rtt
+	}
+	return rtts
+}
+
+// Flush forces any handshakes that are still in progress to time out.  It's
+// meant to be called once a pcap file has been fully replayed, when there's
+// no more live traffic left to complete them.  It returns the number of
+// partial handshakes that were discarded.
+func (s *stateMachine) Flush() int {
+	s.Lock()
+	defer s.Unlock()
+
+	discarded := len(s.m)
+	s.m = make(map[fourTuple]*handshake)
+	return discarded
+}
+
 // deleteStateForPkt deletes the state (if any) we maintain for the given
 // packet.
 func (s *stateMachine) deleteStateForPkt(p gopacket.Packet) error {
@@ -0,0 +1,498 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	synProbeResultsFile = "results/synprobe_rtt.csv"
+	synProbeTimeout     = 2 * time.Second
+	arpResolveTimeout   = 2 * time.Second
+)
+
+var (
+	errNoResponse    = errors.New("no response to SYN probe")
+	errProbeTimeout  = errors.New("timed out waiting for SYN/ACK")
+	errNoARPReply    = errors.New("no ARP reply from next hop")
+	errNoRouteFound  = errors.New("no route to destination")
+	errUnsupportedIP = errors.New("destination address is neither IPv4 nor IPv6")
+)
+
+// synProbeTarget is one host:port pair from the -probe flag, resolved to an
+// IP address.
+type synProbeTarget struct {
+	host string
+	port uint16
+	ip   net.IP
+}
+
+// parseProbeTargets parses a comma-separated "host:port,host:port,..." flag
+// value, resolving each host along the way.
+func parseProbeTargets(spec string) ([]synProbeTarget, error) {
+	var targets []synProbeTarget
+	for _, hp := range strings.Split(spec, ",") {
+		hp = strings.TrimSpace(hp)
+		if hp == "" {
+			continue
+		}
+		host, portStr, err := net.SplitHostPort(hp)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -probe target %q: %w", hp, err)
+		}
+		port, err := strconv.ParseUint(portStr, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port in %q: %w", hp, err)
+		}
+		ips, err := net.LookupIP(host)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve %q: %w", host, err)
+		}
+		targets = append(targets, synProbeTarget{host: host, port: uint16(port), ip: ips[0]})
+	}
+	return targets, nil
+}
+
+// route describes how to reach a destination: the outgoing interface, the
+// source address we should use, and the link-layer next hop (the gateway,
+// or the destination itself if it's directly connected).
+type route struct {
+	iface   *net.Interface
+	srcIP   net.IP
+	nextHop net.IP
+}
+
+// routeTo looks up, via netlink, how the kernel would route traffic to dst.
+func routeTo(dst net.IP) (*route, error) {
+	routes, err := netlink.RouteGet(dst)
+	if err != nil {
+		return nil, fmt.Errorf("route lookup for %s failed: %w", dst, err)
+	}
+	if len(routes) == 0 {
+		return nil, errNoRouteFound
+	}
+	r := routes[0]
+	iface, err := net.InterfaceByIndex(r.LinkIndex)
+	if err != nil {
+		return nil, err
+	}
+	nextHop := r.Gw
+	if nextHop == nil {
+		nextHop = dst
+	}
+	srcIP := r.Src
+	if srcIP == nil {
+		srcIP, err = firstAddrOnIface(iface, dst.To4() != nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &route{iface: iface, srcIP: srcIP, nextHop: nextHop}, nil
+}
+
+func firstAddrOnIface(iface *net.Interface, v4 bool) (net.IP, error) {
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range addrs {
+		ipNet, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if (ipNet.IP.To4() != nil) == v4 {
+			return ipNet.IP, nil
+		}
+	}
+	return nil, fmt.Errorf("no suitable source address on %s", iface.Name)
+}
+
+// resolveMAC resolves nextHop's link-layer address via ARP (IPv4) or NDP
+// (IPv6), using a short-lived pcap handle on iface.
+func resolveMAC(iface *net.Interface, srcIP, nextHop net.IP) (net.HardwareAddr, error) {
+	handle, err := pcap.OpenLive(iface.Name, 1600, true, arpResolveTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open pcap handle on %s: %w", iface.Name, err)
+	}
+	defer handle.Close()
+
+	if nextHop.To4() != nil {
+		return resolveMACv4(handle, iface, srcIP, nextHop)
+	}
+	return resolveMACv6(handle, iface, srcIP, nextHop)
+}
+
+func resolveMACv4(handle *pcap.Handle, iface *net.Interface, srcIP, nextHop net.IP) (net.HardwareAddr, error) {
+	if err := handle.SetBPFFilter("arp"); err != nil {
+		return nil, err
+	}
+
+	eth := layers.Ethernet{
+		SrcMAC:       iface.HardwareAddr,
+		DstMAC:       net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		EthernetType: layers.EthernetTypeARP,
+	}
+	arp := layers.ARP{
+		AddrType:          layers.LinkTypeEthernet,
+		Protocol:          layers.EthernetTypeIPv4,
+		HwAddressSize:     6,
+		ProtAddressSize:   4,
+		Operation:         layers.ARPRequest,
+		SourceHwAddress:   iface.HardwareAddr,
+		SourceProtAddress: srcIP.To4(),
+		DstHwAddress:      net.HardwareAddr{0, 0, 0, 0, 0, 0},
+		DstProtAddress:    nextHop.To4(),
+	}
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true}
+	if err := gopacket.SerializeLayers(buf, opts, &eth, &arp); err != nil {
+		return nil, err
+	}
+	if err := handle.WritePacketData(buf.Bytes()); err != nil {
+		return nil, err
+	}
+
+	src := gopacket.NewPacketSource(handle, handle.LinkType())
+	deadline := time.After(arpResolveTimeout)
+	for {
+		select {
+		case p := <-src.Packets():
+			if p == nil {
+				return nil, errNoARPReply
+			}
+			reply, ok := p.Layer(layers.LayerTypeARP).(*layers.ARP)
+			if !ok || reply.Operation != layers.ARPReply {
+				continue
+			}
+			if net.IP(reply.SourceProtAddress).Equal(nextHop) {
+				return net.HardwareAddr(reply.SourceHwAddress), nil
+			}
+		case <-deadline:
+			return nil, errNoARPReply
+		}
+	}
+}
+
+// resolveMACv6 resolves nextHop's link-layer address via a Neighbor
+// Solicitation, mirroring resolveMACv4's ARP exchange for IPv6.
+func resolveMACv6(handle *pcap.Handle, iface *net.Interface, srcIP, nextHop net.IP) (net.HardwareAddr, error) {
+	if err := handle.SetBPFFilter("icmp6"); err != nil {
+		return nil, err
+	}
+
+	solicitedNodeMcast := net.HardwareAddr{0x33, 0x33, 0xff, nextHop.To16()[13], nextHop.To16()[14], nextHop.To16()[15]}
+	eth := layers.Ethernet{
+		SrcMAC:       iface.HardwareAddr,
+		DstMAC:       solicitedNodeMcast,
+		EthernetType: layers.EthernetTypeIPv6,
+	}
+	ip6 := layers.IPv6{
+		Version:    6,
+		NextHeader: layers.IPProtocolICMPv6,
+		HopLimit:   255,
+		SrcIP:      srcIP,
+		DstIP:      nextHop,
+	}
+	ns := layers.ICMPv6NeighborSolicitation{TargetAddress: nextHop}
+	icmp6 := layers.ICMPv6{TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeNeighborSolicitation, 0)}
+	_ = icmp6.SetNetworkLayerForChecksum(&ip6)
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, &eth, &ip6, &icmp6, &ns); err != nil {
+		return nil, err
+	}
+	if err := handle.WritePacketData(buf.Bytes()); err != nil {
+		return nil, err
+	}
+
+	src := gopacket.NewPacketSource(handle, handle.LinkType())
+	deadline := time.After(arpResolveTimeout)
+	for {
+		select {
+		case p := <-src.Packets():
+			if p == nil {
+				return nil, errNoARPReply
+			}
+			if ethLayer, ok := p.Layer(layers.LayerTypeEthernet).(*layers.Ethernet); ok {
+				if na, ok := p.Layer(layers.LayerTypeICMPv6NeighborAdvertisement).(*layers.ICMPv6NeighborAdvertisement); ok {
+					if na.TargetAddress.Equal(nextHop) {
+						return ethLayer.SrcMAC, nil
+					}
+				}
+			}
+		case <-deadline:
+			return nil, errNoARPReply
+		}
+	}
+}
+
+func randomSourcePort() uint16 {
+	buf := make([]byte, 2)
+	_, _ = rand.Read(buf)
+	// Stay within the ephemeral port range.
+	return uint16(binary.BigEndian.Uint16(buf)%(65535-32768)) + 32768
+}
+
+func randomISN() uint32 {
+	buf := make([]byte, 4)
+	_, _ = rand.Read(buf)
+	return binary.BigEndian.Uint32(buf)
+}
+
+// buildSynPacket serializes an Ethernet+IP+TCP SYN segment from
+// (srcIP,srcPort) to (dstIP,dstPort).
+func buildSynPacket(srcMAC, dstMAC net.HardwareAddr, srcIP, dstIP net.IP, srcPort, dstPort uint16, isn uint32) ([]byte, error) {
+	tcp := layers.TCP{
+		SrcPort: layers.TCPPort(srcPort),
+		DstPort: layers.TCPPort(dstPort),
+		Seq:     isn,
+		SYN:     true,
+		Window:  65535,
+	}
+	return buildTCPPacket(srcMAC, dstMAC, srcIP, dstIP, &tcp)
+}
+
+// buildAckPacket serializes the segment that completes (or aborts, if rst is
+// set) a handshake after we've observed the peer's SYN/ACK.
+func buildAckPacket(srcMAC, dstMAC net.HardwareAddr, srcIP, dstIP net.IP, srcPort, dstPort uint16, seq, ack uint32, rst bool) ([]byte, error) {
+	tcp := layers.TCP{
+		SrcPort: layers.TCPPort(srcPort),
+		DstPort: layers.TCPPort(dstPort),
+		Seq:     seq,
+		Ack:     ack,
+		ACK:     true,
+		RST:     rst,
+		Window:  65535,
+	}
+	return buildTCPPacket(srcMAC, dstMAC, srcIP, dstIP, &tcp)
+}
+
+func buildTCPPacket(srcMAC, dstMAC net.HardwareAddr, srcIP, dstIP net.IP, tcp *layers.TCP) ([]byte, error) {
+	eth := layers.Ethernet{SrcMAC: srcMAC, DstMAC: dstMAC}
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+
+	if v4 := dstIP.To4(); v4 != nil {
+		ip4 := layers.IPv4{
+			Version:  4,
+			TTL:      64,
+			Protocol: layers.IPProtocolTCP,
+			SrcIP:    srcIP.To4(),
+			DstIP:    v4,
+		}
+		eth.EthernetType = layers.EthernetTypeIPv4
+		_ = tcp.SetNetworkLayerForChecksum(&ip4)
+		if err := gopacket.SerializeLayers(buf, opts, &eth, &ip4, tcp); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	if v6 := dstIP.To16(); v6 != nil {
+		ip6 := layers.IPv6{
+			Version:    6,
+			NextHeader: layers.IPProtocolTCP,
+			HopLimit:   64,
+			SrcIP:      srcIP.To16(),
+			DstIP:      v6,
+		}
+		eth.EthernetType = layers.EthernetTypeIPv6
+		_ = tcp.SetNetworkLayerForChecksum(&ip6)
+		if err := gopacket.SerializeLayers(buf, opts, &eth, &ip6, tcp); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	return nil, errUnsupportedIP
+}
+
+// probeOnce sends a single SYN to (dstIP,port), waits for the SYN/ACK, and
+// completes the handshake with an ACK so that the shared stateMachine can
+// compute and record the RTT.  handle's capture filter is narrowed to this
+// probe's own four-tuple so that an unrelated handshake completing
+// concurrently on the same interface can't be captured or misattributed to
+// it.
+func probeOnce(handle *pcap.Handle, packets <-chan gopacket.Packet, state *stateMachine,
+	iface *net.Interface, srcMAC, dstMAC net.HardwareAddr, srcIP, dstIP net.IP, srcPort, dstPort uint16) (time.Duration, error) {
+
+	if err := handle.SetBPFFilter(probeFilter(dstIP, srcPort, dstPort)); err != nil {
+		return 0, err
+	}
+
+	tuple := *newFourTuple(srcIP, srcPort, dstIP, dstPort)
+
+	isn := randomISN()
+	synPkt, err := buildSynPacket(srcMAC, dstMAC, srcIP, dstIP, srcPort, dstPort, isn)
+	if err != nil {
+		return 0, err
+	}
+	if err := handle.WritePacketData(synPkt); err != nil {
+		return 0, err
+	}
+
+	deadline := time.After(synProbeTimeout)
+	for {
+		select {
+		case p, ok := <-packets:
+			if !ok {
+				return 0, errNoResponse
+			}
+			_ = state.add(p)
+			if isSynAckSegment(p) {
+				tcpLayer, _ := p.Layer(layers.LayerTypeTCP).(*layers.TCP)
+				if tcpLayer == nil || uint16(tcpLayer.DstPort) != srcPort {
+					continue
+				}
+				ackPkt, err := buildAckPacket(srcMAC, dstMAC, srcIP, dstIP, srcPort, dstPort,
+					tcpLayer.Ack, tcpLayer.Seq+1, false)
+				if err != nil {
+					return 0, err
+				}
+				if err := handle.WritePacketData(ackPkt); err != nil {
+					return 0, err
+				}
+			}
+		case <-deadline:
+			return 0, errProbeTimeout
+		}
+
+		if rtt, ok := popRTT(state, tuple); ok {
+			return rtt, nil
+		}
+	}
+}
+
+// probeFilter returns the BPF filter that narrows capture to exactly one
+// probe's handshake: the SYN/ACK and ACK both carry dstIP as one endpoint
+// and {srcPort,dstPort} as the port pair, regardless of which side of the
+// exchange we're seeing at capture time.
+func probeFilter(dstIP net.IP, srcPort, dstPort uint16) string {
+	return fmt.Sprintf("tcp and host %s and port %d and port %d", dstIP, srcPort, dstPort)
+}
+
+// popRTT removes and returns the RTT recorded for tuple, if any.  probeOnce
+// relies on it to pull out the RTT for the handshake it just completed,
+// matching on the probe's own four-tuple rather than assuming the most
+// recently appended sample belongs to it -- state.add() is shared with the
+// rest of this package's passive handshake tracking, so an ambient
+// handshake completing in the probe window would otherwise be misattributed.
+func popRTT(state *stateMachine, tuple fourTuple) (time.Duration, bool) {
+	state.Lock()
+	defer state.Unlock()
+	for i, sample := range state.rtts {
+		if sample.tuple == tuple {
+			rtt := sample.rtt
+			state.rtts = append(state.rtts[:i], state.rtts[i+1:]...)
+			return rtt, true
+		}
+	}
+	return 0, false
+}
+
+// synProbeResult is one row of results/synprobe_rtt.csv.
+type synProbeResult struct {
+	host string
+	ip   net.IP
+	port uint16
+	seq  int
+	rtt  time.Duration
+	err  error
+}
+
+func writeSynProbeResult(r synProbeResult) {
+	if err := os.MkdirAll("results", 0755); err != nil {
+		log.Printf("Failed to create results directory: %v", err)
+		return
+	}
+	fd, err := os.OpenFile(synProbeResultsFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Printf("Failed to open %s: %v", synProbeResultsFile, err)
+		return
+	}
+	defer fd.Close()
+
+	if r.err != nil {
+		fmt.Fprintf(fd, "%s, %s, %d, %d, ,%s\n", r.host, r.ip, r.port, r.seq, r.err)
+		return
+	}
+	fmt.Fprintf(fd, "%s, %s, %d, %d, %d,\n", r.host, r.ip, r.port, r.seq, r.rtt.Microseconds())
+}
+
+// runProbeMode actively measures the TCP handshake RTT to every target in
+// targets, round-robining reps times across all of them with interval
+// between probes, and writes each result to results/synprobe_rtt.csv.
+func runProbeMode(targets []synProbeTarget, reps int, interval time.Duration) {
+	type resolved struct {
+		target synProbeTarget
+		rt     *route
+		dstMAC net.HardwareAddr
+	}
+
+	var resolvedTargets []resolved
+	for _, t := range targets {
+		rt, err := routeTo(t.ip)
+		if err != nil {
+			log.Printf("Skipping %s: %v", t.host, err)
+			continue
+		}
+		dstMAC, err := resolveMAC(rt.iface, rt.srcIP, rt.nextHop)
+		if err != nil {
+			log.Printf("Skipping %s: failed to resolve next hop MAC: %v", t.host, err)
+			continue
+		}
+		resolvedTargets = append(resolvedTargets, resolved{target: t, rt: rt, dstMAC: dstMAC})
+	}
+
+	// Group targets by interface so we open one pcap handle per interface
+	// and round-robin all of a given interface's targets over it.
+	byIface := make(map[string][]resolved)
+	for _, r := range resolvedTargets {
+		byIface[r.rt.iface.Name] = append(byIface[r.rt.iface.Name], r)
+	}
+
+	var wg sync.WaitGroup
+	for ifaceName, group := range byIface {
+		ifaceName, group := ifaceName, group
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			handle, err := pcap.OpenLive(ifaceName, 1600, true, pcap.BlockForever)
+			if err != nil {
+				log.Printf("Failed to open pcap handle on %s: %v", ifaceName, err)
+				return
+			}
+			defer handle.Close()
+
+			state := &stateMachine{clientSide: true, m: make(map[fourTuple]*handshake)}
+			packets := gopacket.NewPacketSource(handle, handle.LinkType()).Packets()
+
+			for seq := 0; seq < reps; seq++ {
+				for _, r := range group {
+					srcPort := randomSourcePort()
+					rtt, err := probeOnce(handle, packets, state, r.rt.iface,
+						r.rt.iface.HardwareAddr, r.dstMAC, r.rt.srcIP, r.target.ip, srcPort, r.target.port)
+					writeSynProbeResult(synProbeResult{
+						host: r.target.host, ip: r.target.ip, port: r.target.port, seq: seq, rtt: rtt, err: err,
+					})
+					time.Sleep(interval)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/reassembly"
+)
+
+const (
+	tlsRecordHeaderLen    = 5 // content type (1) + version (2) + length (2)
+	tlsHandshakeHeaderLen = 4 // handshake type (1) + length (3)
+
+	tlsContentTypeHandshake = 22
+
+	tlsResultsFile = "results/tls_rtt.csv"
+)
+
+var errTLSHandshakeIncomplete = errors.New("TLS handshake incomplete")
+
+// tlsRecordState walks a single direction's byte stream one step at a time,
+// so that a TLS record (or handshake message) split across several TCP
+// segments is handled without needing the whole flow buffered up front.
+type tlsRecordState int
+
+const (
+	expectRecordHeader tlsRecordState = iota
+	expectHandshakeHeader
+	collectingBody
+	done
+)
+
+// tlsRecordParser reconstructs a direction's first handshake message
+// (ClientHello or ServerHello) far enough to hand its body to the JA3/JA3S
+// parser, without attempting to parse any TLS record after the first one.
+type tlsRecordParser struct {
+	state   tlsRecordState
+	buf     []byte
+	hsType  byte
+	bodyLen int
+	body    []byte
+}
+
+// feed appends newly reassembled bytes to the parser.  It returns true the
+// moment the direction's first handshake message body is fully collected, at
+// which point hsType and body are ready to read.
+func (p *tlsRecordParser) feed(data []byte) bool {
+	if p.state == done {
+		return false
+	}
+	p.buf = append(p.buf, data...)
+
+	for {
+		switch p.state {
+		case expectRecordHeader:
+			if len(p.buf) < tlsRecordHeaderLen {
+				return false
+			}
+			contentType := p.buf[0]
+			p.buf = p.buf[tlsRecordHeaderLen:]
+			if contentType != tlsContentTypeHandshake {
+				// Not a handshake record; we only care about the first one
+				// seen in each direction, so there's nothing left to learn.
+				p.state = done
+				return false
+			}
+			p.state = expectHandshakeHeader
+		case expectHandshakeHeader:
+			if len(p.buf) < tlsHandshakeHeaderLen {
+				return false
+			}
+			p.hsType = p.buf[0]
+			p.bodyLen = int(p.buf[1])<<16 | int(p.buf[2])<<8 | int(p.buf[3])
+			p.buf = p.buf[tlsHandshakeHeaderLen:]
+			p.state = collectingBody
+		case collectingBody:
+			if len(p.buf) < p.bodyLen {
+				return false
+			}
+			p.body = p.buf[:p.bodyLen]
+			p.state = done
+			return true
+		default:
+			return false
+		}
+	}
+}
+
+// tlsConnState tracks, for one TCP connection, the per-direction record
+// parser along with the timestamps and fingerprints derived from the
+// client's ClientHello and the server's ServerHello.
+type tlsConnState struct {
+	client, server      tlsRecordParser
+	firstClientHelloTS  time.Time
+	firstServerFlightTS time.Time
+	ja3, ja3Hash        string
+	ja3s, ja3sHash      string
+	sni                 string
+	lastSeen            time.Time
+}
+
+func (c *tlsConnState) complete() bool {
+	return !c.firstClientHelloTS.IsZero() && !c.firstServerFlightTS.IsZero()
+}
+
+// rtt returns the time between the client's ClientHello and the server's
+// first handshake record.
+func (c *tlsConnState) rtt() (time.Duration, error) {
+	if !c.complete() {
+		return 0, errTLSHandshakeIncomplete
+	}
+	return c.firstServerFlightTS.Sub(c.firstClientHelloTS), nil
+}
+
+// tlsTracker holds the TLS handshake state for every connection currently
+// being reassembled, keyed by four-tuple.  It's pruned the same way
+// stateMachine is: connections idle for longer than handshakeIdleTimeout are
+// dropped.
+type tlsTracker struct {
+	sync.RWMutex
+	conns map[fourTuple]*tlsConnState
+}
+
+func newTLSTracker() *tlsTracker {
+	return &tlsTracker{conns: make(map[fourTuple]*tlsConnState)}
+}
+
+func (t *tlsTracker) prune() int {
+	t.Lock()
+	defer t.Unlock()
+
+	now := time.Now()
+	deleted := 0
+	for tuple, c := range t.conns {
+		if now.Sub(c.lastSeen) > handshakeIdleTimeout {
+			delete(t.conns, tuple)
+			deleted++
+		}
+	}
+	return deleted
+}
+
+// drop removes the given connection's TLS state, e.g. because we observed a
+// FIN or RST for it.
+func (t *tlsTracker) drop(tuple fourTuple) {
+	t.Lock()
+	delete(t.conns, tuple)
+	t.Unlock()
+}
+
+// tlsStreamOpts controls how tolerant the reassembly.Stream implementations
+// below are of imperfect captures, mirroring the flags gopacket's own
+// examples expose for the same purpose.
+type tlsStreamOpts struct {
+	// nodefrag disables the IPv4 defragmentation that processPkts
+	// otherwise performs before handing packets to the assembler, so
+	// fragmented ClientHello/ServerHello records never reach us whole.
+	nodefrag bool
+	// nooptcheck relaxes the RST handling below, which matters when a
+	// capture is missing packets and would otherwise look like a reset
+	// connection.
+	nooptcheck bool
+	// allowmissinginit accepts a connection into the assembler even if we
+	// didn't see its initial SYN, which otherwise gets discarded.
+	allowmissinginit bool
+}
+
+// tlsStreamFactory produces the shared reassembly.Stream for each TCP
+// connection we reassemble, and is how gopacket/reassembly's Assembler tells
+// us apart about new connections.
+type tlsStreamFactory struct {
+	tracker *tlsTracker
+	opts    tlsStreamOpts
+}
+
+func newTLSStreamFactory(tracker *tlsTracker, opts tlsStreamOpts) *tlsStreamFactory {
+	return &tlsStreamFactory{tracker: tracker, opts: opts}
+}
+
+func (f *tlsStreamFactory) New(net, transport gopacket.Flow, tcp *layers.TCP, ac reassembly.AssemblerContext) reassembly.Stream {
+	srcEndpoint, dstEndpoint := net.Endpoints()
+	tuple := newFourTuple(
+		srcEndpoint.Raw(), uint16(tcp.SrcPort),
+		dstEndpoint.Raw(), uint16(tcp.DstPort),
+	)
+
+	f.tracker.Lock()
+	connState, exists := f.tracker.conns[*tuple]
+	if !exists {
+		connState = &tlsConnState{lastSeen: time.Now()}
+		f.tracker.conns[*tuple] = connState
+	}
+	f.tracker.Unlock()
+
+	return &tlsStream{
+		tracker: f.tracker,
+		tuple:   *tuple,
+		conn:    connState,
+		opts:    f.opts,
+	}
+}
+
+// tlsStream implements reassembly.Stream for a TCP connection.  A single
+// tlsStream instance handles both directions; ReassembledSG tells them apart
+// via sg.Info()'s reported direction rather than us tracking it ourselves.
+type tlsStream struct {
+	tracker *tlsTracker
+	tuple   fourTuple
+	conn    *tlsConnState
+	opts    tlsStreamOpts
+}
+
+func (s *tlsStream) Accept(tcp *layers.TCP, ci gopacket.CaptureInfo, dir reassembly.TCPFlowDirection, nextSeq reassembly.Sequence, start *bool, ac reassembly.AssemblerContext) bool {
+	if !s.opts.nooptcheck && tcp.RST {
+		return false
+	}
+	if s.opts.allowmissinginit {
+		*start = true
+	}
+	return true
+}
+
+func (s *tlsStream) ReassembledSG(sg reassembly.ScatterGather, ac reassembly.AssemblerContext) {
+	length, _ := sg.Lengths()
+	if length == 0 {
+		sg.KeepFrom(0)
+		return
+	}
+	data := sg.Fetch(length)
+	ts := sg.CaptureInfo(0).Timestamp
+	dir, _, _, _ := sg.Info()
+
+	s.tracker.Lock()
+	s.conn.lastSeen = ts
+
+	parser := &s.conn.server
+	if dir == reassembly.TCPDirClientToServer {
+		parser = &s.conn.client
+	}
+	if parser.feed(data) {
+		s.recordHello(parser, ts)
+	}
+
+	var rtt time.Duration
+	var rttErr error
+	var ja3Str, ja3HashStr, ja3sStr, ja3sHashStr, sni string
+	if s.conn.complete() {
+		rtt, rttErr = s.conn.rtt()
+		ja3Str, ja3HashStr = s.conn.ja3, s.conn.ja3Hash
+		ja3sStr, ja3sHashStr = s.conn.ja3s, s.conn.ja3sHash
+		sni = s.conn.sni
+		delete(s.tracker.conns, s.tuple)
+	}
+	s.tracker.Unlock()
+
+	if rttErr == nil && rtt > 0 {
+		writeTLSRTT(s.tuple, rtt, ja3Str, ja3HashStr, ja3sStr, ja3sHashStr, sni)
+	}
+
+	sg.KeepFrom(0)
+}
+
+// recordHello fingerprints a just-completed ClientHello or ServerHello and
+// stashes the result, plus the timestamp used for the RTT calculation, on
+// the connection state.  Must be called with s.tracker locked.
+func (s *tlsStream) recordHello(parser *tlsRecordParser, ts time.Time) {
+	switch parser.hsType {
+	case tlsHandshakeTypeClientHello:
+		if !s.conn.firstClientHelloTS.IsZero() {
+			return
+		}
+		s.conn.firstClientHelloTS = ts
+		ch, err := parseClientHello(parser.body)
+		if err != nil {
+			log.Printf("Failed to parse ClientHello for %s: %v", s.tuple, err)
+			return
+		}
+		s.conn.ja3, s.conn.ja3Hash = ja3(ch)
+		s.conn.sni = ch.sni
+	case tlsHandshakeTypeServerHello:
+		if !s.conn.firstServerFlightTS.IsZero() {
+			return
+		}
+		s.conn.firstServerFlightTS = ts
+		sh, err := parseServerHello(parser.body)
+		if err != nil {
+			log.Printf("Failed to parse ServerHello for %s: %v", s.tuple, err)
+			return
+		}
+		s.conn.ja3s, s.conn.ja3sHash = ja3s(sh)
+	}
+}
+
+func (s *tlsStream) ReassemblyComplete(ac reassembly.AssemblerContext) bool {
+	return true
+}
+
+// writeTLSRTT appends one row to results/tls_rtt.csv for a completed TLS
+// handshake: the four-tuple, the handshake RTT, and the JA3/JA3S
+// fingerprints (and SNI) observed for it, if any.
+func writeTLSRTT(tuple fourTuple, rtt time.Duration, ja3, ja3Hash, ja3s, ja3sHash, sni string) {
+	if err := os.MkdirAll("results", 0755); err != nil {
+		log.Printf("Failed to create results directory: %v", err)
+		return
+	}
+	fd, err := os.OpenFile(tlsResultsFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Printf("Failed to open %s: %v", tlsResultsFile, err)
+		return
+	}
+	defer fd.Close()
+
+	fmt.Fprintf(fd, "%s, %d, %s, %s, %s, %s, %s\n",
+		tuple.String(), rtt.Microseconds(), ja3, ja3Hash, ja3s, ja3sHash, sni)
+	log.Printf("TLS handshake RTT for %s: %s (ja3=%s ja3s=%s sni=%q)", tuple.String(), rtt, ja3Hash, ja3sHash, sni)
+}
+
+// packetContext is the minimal reassembly.AssemblerContext our packet loop
+// needs: it just hands the packet's capture timestamp through to the
+// Assembler.
+type packetContext struct {
+	ci gopacket.CaptureInfo
+}
+
+func (c *packetContext) GetCaptureInfo() gopacket.CaptureInfo {
+	return c.ci
+}
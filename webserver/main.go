@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/tls"
 	"errors"
 	"flag"
 	"fmt"
@@ -9,6 +10,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"sync"
 	"time"
 
 	"github.com/google/gopacket"
@@ -38,6 +40,8 @@ var (
 	certPath               string
 	keyPath                string
 	filePath               string
+	pcapFile               string
+	bus                    = newMeasurementBus()
 )
 
 // filter returns the pcap filter that we use to capture TCP handshakes for the
@@ -57,11 +61,107 @@ func processPkts(handle *pcap.Handle, s *stateMachine) {
 	}
 }
 
-func startWebServer(port int, certPath string, keyPath string) {
+const rttResultsFile = "results/handshake_rtt.csv"
+
+// dumpRTTs appends the accumulated handshake RTTs to results/handshake_rtt.csv.
+func dumpRTTs(s *stateMachine) {
+	s.RLock()
+	defer s.RUnlock()
+
+	path := filePath + rttResultsFile
+	fd, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Fatalf("Failed to open %s: %v", path, err)
+	}
+	defer fd.Close()
+
+	for _, rtt := range s.rtts {
+		fmt.Fprintf(fd, "%d, %d\n", time.Now().Unix(), rtt.Microseconds())
+	}
+	log.Printf("Wrote %d RTTs to: %s", len(s.rtts), path)
+}
+
+// timingListener wraps a plain TCP listener and hands back connections that
+// time their own TLS handshake and publish the result to bus.  Accept itself
+// never performs the handshake: net/http calls Accept serially from a single
+// accept loop, so a slow or stalled client there would block every other
+// incoming connection behind it.
+type timingListener struct {
+	net.Listener
+	tlsConfig *tls.Config
+	bus       *measurementBus
+}
+
+func (l *timingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return newTimingConn(conn, l.tlsConfig, l.bus), nil
+}
+
+// timingConn defers its TLS handshake to the first Read or Write, which
+// net/http performs from the connection's own serving goroutine rather than
+// the accept loop, and reports the handshake's duration to bus once it
+// completes.
+type timingConn struct {
+	*tls.Conn
+	bus   *measurementBus
+	once  sync.Once
+	hsErr error
+}
+
+func newTimingConn(conn net.Conn, tlsConfig *tls.Config, bus *measurementBus) *timingConn {
+	return &timingConn{Conn: tls.Server(conn, tlsConfig), bus: bus}
+}
+
+func (c *timingConn) handshake() error {
+	c.once.Do(func() {
+		then := time.Now()
+		c.hsErr = c.Conn.Handshake()
+		if c.hsErr != nil {
+			log.Printf("TLS handshake with %s failed: %v", c.Conn.RemoteAddr(), c.hsErr)
+			return
+		}
+		if key, ok := sessionKeyFromAddr(c.Conn.RemoteAddr().String()); ok {
+			c.bus.publishTLS(key, time.Since(then))
+		}
+	})
+	return c.hsErr
+}
+
+func (c *timingConn) Read(b []byte) (int, error) {
+	if err := c.handshake(); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *timingConn) Write(b []byte) (int, error) {
+	if err := c.handshake(); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(b)
+}
+
+func startWebServer(port int, certPath string, keyPath string, bus *measurementBus) {
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		log.Fatalf("Failed to load TLS certificate: %v", err)
+	}
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		log.Fatalf("Failed to listen on port %d: %v", port, err)
+	}
+	tl := &timingListener{
+		Listener:  ln,
+		tlsConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+		bus:       bus,
+	}
+
 	http.HandleFunc("/", indexHandler)
-	addr := fmt.Sprintf(":%d", port)
-	log.Printf("Starting Web server at %s.", addr)
-	log.Fatal(http.ListenAndServeTLS(addr, certPath, keyPath, nil))
+	log.Printf("Starting Web server at :%d.", port)
+	log.Fatal(http.Serve(tl, nil))
 }
 
 func webSocketHandler(w http.ResponseWriter, r *http.Request) {
@@ -116,6 +216,10 @@ func webSocketHandler(w http.ResponseWriter, r *http.Request) {
 	} else {
 		log.Fatalf("Failed to open file: %v", err)
 	}
+
+	if key, ok := sessionKeyFromAddr(srcAddr); ok {
+		bus.flush(key, ms)
+	}
 }
 
 func indexHandler(w http.ResponseWriter, r *http.Request) {
@@ -170,6 +274,10 @@ func sendICMPPing(srcAddr string) {
 	} else {
 		log.Fatalf("Failed to open file: %v", err)
 	}
+
+	if key, ok := sessionKeyFromAddr(srcAddr); ok {
+		bus.publishICMP(key, rtts)
+	}
 }
 
 func ping(addr string) (time.Duration, error) {
@@ -239,9 +347,11 @@ func main() {
 	flag.StringVar(&certPath, "cert", "cert.pem", "Path to TLS certificate")
 	flag.StringVar(&keyPath, "key", "key.pem", "Path to TLS private key")
 	flag.StringVar(&filePath, "path", "./", "Path to save results")
+	flag.StringVar(&pcapFile, "r", "",
+		"Replay handshakes from this pcap file instead of capturing live traffic")
 	flag.Parse()
 
-	if iface == "" {
+	if iface == "" && pcapFile == "" {
 		ifaces, err := net.Interfaces()
 		if err != nil {
 			log.Fatalf("Failed to list network interfaces: %v", err)
@@ -264,27 +374,60 @@ func main() {
 		_ = os.Mkdir(filePath+"results", 0755)
 	}
 
-	go startWebServer(srvPort, certPath, keyPath)
+	if pcapFile == "" {
+		go startWebServer(srvPort, certPath, keyPath, bus)
+
+		// Periodically drop sessions that published a sample but never
+		// completed a WebSocket upgrade to flush them.
+		go func() {
+			for range time.Tick(sessionTTL) {
+				if pruned := bus.prune(); pruned > 0 {
+					log.Printf("Pruned %d stale sessions from the measurement bus.", pruned)
+				}
+			}
+		}()
+	}
 
 	state := &stateMachine{
 		clientSide: false,
 		m:          make(map[fourTuple]*handshake),
+		bus:        bus,
 	}
 
-	// Upon receiving ctrl+c, we write our data to a file and exit.
+	// Upon receiving ctrl+c, we write our data to a file and exit.  This only
+	// matters for live capture; pcap replay finishes on its own below.
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
 	go func() {
 		<-c
+		dumpRTTs(state)
 		os.Exit(0)
 	}()
 
-	handle, err := pcap.OpenLive(iface, 1600, true, pcap.BlockForever)
-	if err != nil {
-		log.Fatalf("Failed to create pcap handle: %v", err)
+	var handle *pcap.Handle
+	var err error
+	if pcapFile != "" {
+		handle, err = pcap.OpenOffline(pcapFile)
+		if err != nil {
+			log.Fatalf("Failed to open pcap file %s: %v", pcapFile, err)
+		}
+	} else {
+		handle, err = pcap.OpenLive(iface, 1600, true, pcap.BlockForever)
+		if err != nil {
+			log.Fatalf("Failed to create pcap handle: %v", err)
+		}
 	}
 	if err = handle.SetBPFFilter(filter(srvPort)); err != nil {
 		log.Fatalf("Failed to set pcap filter: %v", err)
 	}
 	processPkts(handle, state)
+
+	// processPkts only returns once the packet source is exhausted, which
+	// happens for pcap replay but never for live capture.
+	if pcapFile != "" {
+		if discarded := state.Flush(); discarded > 0 {
+			log.Printf("Flushed %d partial handshakes after replay.", discarded)
+		}
+		dumpRTTs(state)
+	}
 }
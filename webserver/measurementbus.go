@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	sessionResultsFile = "results/sessions.csv"
+	// sessionTTL bounds how long the bus holds on to a session that was
+	// published to (e.g. an ICMP sample) but never flushed, e.g. because the
+	// WebSocket upgrade that would have flushed it never happened.
+	sessionTTL = 30 * time.Second
+)
+
+// sessionKey identifies a client session the way it's observed at
+// WebSocket-upgrade time: by the client's remote IP and port.
+type sessionKey struct {
+	ip   string
+	port uint16
+}
+
+// sessionKeyFromAddr parses a "host:port" remote address, as returned by
+// net.Conn.RemoteAddr().String() or http.Request.RemoteAddr, into a
+// sessionKey.
+func sessionKeyFromAddr(addr string) (sessionKey, bool) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return sessionKey{}, false
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return sessionKey{}, false
+	}
+	return sessionKey{ip: host, port: uint16(port)}, true
+}
+
+// clientEndpoint picks the client side out of a fourTuple, assuming (as is
+// true for the ephemeral-vs-well-known ports used by an ordinary TCP client)
+// that the client used the higher port number.  fourTuple itself doesn't
+// preserve which side is the client, since newFourTuple normalizes the pair
+// so the same connection always hashes to the same key.
+func clientEndpoint(t fourTuple) sessionKey {
+	if t.srcPort > t.dstPort {
+		return sessionKey{ip: t.srcAddr, port: t.srcPort}
+	}
+	return sessionKey{ip: t.dstAddr, port: t.dstPort}
+}
+
+// sessionRecord accumulates every measurement published for one client
+// session.  Samples can arrive out of order and from independent goroutines
+// (the ICMP pinger, the pcap-based handshake RTT collector, the TLS
+// listener, and the WebSocket handler itself), so every field stays unset
+// until something actually publishes to it.
+type sessionRecord struct {
+	icmp     []time.Duration
+	tcpRTT   time.Duration
+	haveTCP  bool
+	tlsRTT   time.Duration
+	haveTLS  bool
+	appLayer []time.Duration
+	created  time.Time
+}
+
+// measurementBus correlates the independent RTT measurements this tool
+// takes for a single client -- ICMP, TCP handshake, TLS handshake, and
+// WebSocket application-layer RTT -- keyed by the client's
+// (remoteIP, remotePort) observed at WebSocket-upgrade time.  It's safe for
+// concurrent use by all four measurement paths.
+type measurementBus struct {
+	sync.Mutex
+	sessions map[sessionKey]*sessionRecord
+}
+
+func newMeasurementBus() *measurementBus {
+	return &measurementBus{sessions: make(map[sessionKey]*sessionRecord)}
+}
+
+func (b *measurementBus) getOrCreate(key sessionKey) *sessionRecord {
+	rec, ok := b.sessions[key]
+	if !ok {
+		rec = &sessionRecord{created: time.Now()}
+		b.sessions[key] = rec
+	}
+	return rec
+}
+
+func (b *measurementBus) publishICMP(key sessionKey, rtts []time.Duration) {
+	b.Lock()
+	defer b.Unlock()
+	rec := b.getOrCreate(key)
+	rec.icmp = append(rec.icmp, rtts...)
+}
+
+func (b *measurementBus) publishTCP(key sessionKey, rtt time.Duration) {
+	b.Lock()
+	defer b.Unlock()
+	rec := b.getOrCreate(key)
+	rec.tcpRTT = rtt
+	rec.haveTCP = true
+}
+
+func (b *measurementBus) publishTLS(key sessionKey, rtt time.Duration) {
+	b.Lock()
+	defer b.Unlock()
+	rec := b.getOrCreate(key)
+	rec.tlsRTT = rtt
+	rec.haveTLS = true
+}
+
+// prune drops sessions that have sat in the bus for longer than sessionTTL
+// without being flushed, e.g. because their ICMP or TCP samples arrived but
+// the client never completed a WebSocket upgrade.
+func (b *measurementBus) prune() int {
+	b.Lock()
+	defer b.Unlock()
+
+	now := time.Now()
+	deleted := 0
+	for key, rec := range b.sessions {
+		if now.Sub(rec.created) > sessionTTL {
+			delete(b.sessions, key)
+			deleted++
+		}
+	}
+	return deleted
+}
+
+// sessionSummary is one consolidated row correlating all four RTT
+// measurements for a session.
+type sessionSummary struct {
+	SessionID      string `json:"session_id"`
+	ClientIP       string `json:"client_ip"`
+	ICMPMinUs      int64  `json:"icmp_min_us"`
+	ICMPMedUs      int64  `json:"icmp_med_us"`
+	ICMPMaxUs      int64  `json:"icmp_max_us"`
+	TCPHandshakeUs int64  `json:"tcp_handshake_us"`
+	TLSHandshakeUs int64  `json:"tls_handshake_us"`
+	AppMinUs       int64  `json:"app_min_us"`
+	AppMedUs       int64  `json:"app_med_us"`
+	AppMaxUs       int64  `json:"app_max_us"`
+	AppMeanUs      int64  `json:"app_mean_us"`
+	AppJitterUs    int64  `json:"app_jitter_us"`
+}
+
+// flush consolidates every measurement published for key plus the given
+// application-layer samples (the WebSocket handler doesn't publish those
+// until it's done pinging), writes one row to results/sessions.csv and one
+// JSON line to stdout, and forgets the session.
+func (b *measurementBus) flush(key sessionKey, appLayer []time.Duration) {
+	b.Lock()
+	rec, ok := b.sessions[key]
+	if !ok {
+		rec = &sessionRecord{created: time.Now()}
+	}
+	delete(b.sessions, key)
+	b.Unlock()
+
+	summary := sessionSummary{
+		SessionID: fmt.Sprintf("%s:%d-%d", key.ip, key.port, rec.created.UnixNano()),
+		ClientIP:  key.ip,
+	}
+	if len(rec.icmp) > 0 {
+		lo, med, hi := minMedMax(rec.icmp)
+		summary.ICMPMinUs, summary.ICMPMedUs, summary.ICMPMaxUs = lo.Microseconds(), med.Microseconds(), hi.Microseconds()
+	}
+	if rec.haveTCP {
+		summary.TCPHandshakeUs = rec.tcpRTT.Microseconds()
+	}
+	if rec.haveTLS {
+		summary.TLSHandshakeUs = rec.tlsRTT.Microseconds()
+	}
+	if len(appLayer) > 0 {
+		lo, med, hi := minMedMax(appLayer)
+		summary.AppMinUs, summary.AppMedUs, summary.AppMaxUs = lo.Microseconds(), med.Microseconds(), hi.Microseconds()
+		summary.AppMeanUs = meanDuration(appLayer).Microseconds()
+		summary.AppJitterUs = jitterDuration(appLayer).Microseconds()
+	}
+
+	writeSessionCSV(summary)
+	writeSessionJSON(summary)
+}
+
+func minMedMax(ds []time.Duration) (lo, med, hi time.Duration) {
+	sorted := append([]time.Duration(nil), ds...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[0], sorted[len(sorted)/2], sorted[len(sorted)-1]
+}
+
+func meanDuration(ds []time.Duration) time.Duration {
+	var sum time.Duration
+	for _, d := range ds {
+		sum += d
+	}
+	return sum / time.Duration(len(ds))
+}
+
+// jitterDuration approximates the RFC 3550, section A.8, jitter estimate:
+// the mean absolute difference between consecutive samples.
+func jitterDuration(ds []time.Duration) time.Duration {
+	if len(ds) < 2 {
+		return 0
+	}
+	var sum time.Duration
+	for i := 1; i < len(ds); i++ {
+		d := ds[i] - ds[i-1]
+		if d < 0 {
+			d = -d
+		}
+		sum += d
+	}
+	return sum / time.Duration(len(ds)-1)
+}
+
+func writeSessionCSV(s sessionSummary) {
+	path := filePath + sessionResultsFile
+	fd, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Printf("Failed to open %s: %v", path, err)
+		return
+	}
+	defer fd.Close()
+
+	fmt.Fprintf(fd, "%s, %s, %d, %d, %d, %d, %d, %d, %d, %d, %d, %d\n",
+		s.SessionID, s.ClientIP,
+		s.ICMPMinUs, s.ICMPMedUs, s.ICMPMaxUs,
+		s.TCPHandshakeUs, s.TLSHandshakeUs,
+		s.AppMinUs, s.AppMedUs, s.AppMaxUs, s.AppMeanUs, s.AppJitterUs)
+}
+
+// writeSessionJSON emits the session summary as a JSON line on stdout, for
+// operators who want to pipe sessions into another tool.
+func writeSessionJSON(s sessionSummary) {
+	enc := json.NewEncoder(os.Stdout)
+	if err := enc.Encode(s); err != nil {
+		log.Printf("Failed to encode session summary: %v", err)
+	}
+}
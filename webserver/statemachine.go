@@ -15,6 +15,10 @@ type stateMachine struct {
 	clientSide bool
 	m          map[fourTuple]*handshake
 	rtts       []time.Duration
+	// bus, if set, gets published to with the client's TCP handshake RTT as
+	// soon as it completes, so it can be correlated with the client's other
+	// RTT measurements.
+	bus *measurementBus
 }
 
 func (s *stateMachine) prune() int {
@@ -111,12 +115,29 @@ func (s *stateMachine) add(p gopacket.Packet) error {
 			s.Unlock()
 			_ = s.deleteStateForPkt(p)
 			log.Printf("TCP handshake RTT: %v", rtt)
+
+			if s.bus != nil {
+				if tuple, err := pktToTuple(p); err == nil {
+					s.bus.publishTCP(clientEndpoint(*tuple), rtt)
+				}
+			}
 		}
 	}
 
 	return nil
 }
 
+// Flush forces any handshakes that are still in progress to time out,
+// discarding their state.  It's used after a pcap replay finishes, since
+// there's no live traffic left to complete them.
+func (s *stateMachine) Flush() int {
+	s.Lock()
+	defer s.Unlock()
+	discarded := len(s.m)
+	s.m = make(map[fourTuple]*handshake)
+	return discarded
+}
+
 // deleteStateForPkt deletes the state (if any) we maintain for the given
 // packet.
 func (s *stateMachine) deleteStateForPkt(p gopacket.Packet) error {
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const latencyResultsFile = "results/latency_sessions.jsonl"
+
+// sessionKey identifies a browser session by the peer address observed on
+// its TCP connection, i.e. before any WebSocket upgrade takes place.
+type sessionKey struct {
+	ip   string
+	port uint16
+}
+
+// sessionKeyFromAddr parses a "host:port" remote address, as returned by
+// net.Conn.RemoteAddr().String(), into a sessionKey.
+func sessionKeyFromAddr(addr string) (sessionKey, bool) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return sessionKey{}, false
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return sessionKey{}, false
+	}
+	return sessionKey{ip: host, port: uint16(port)}, true
+}
+
+// sessionRecord holds the TCP-layer RTT published for one session, if any,
+// while we wait for the WebSocket handler to finish collecting its
+// application-layer samples.
+type sessionRecord struct {
+	tcpRTT  time.Duration
+	haveTCP bool
+	created time.Time
+}
+
+// sessionBus correlates the zerotrace-measured TCP RTT of a session's
+// underlying connection with the application-layer RTTs the WebSocket
+// handler measures for the same session, keyed by the peer's address.
+type sessionBus struct {
+	sync.Mutex
+	sessions map[sessionKey]*sessionRecord
+}
+
+func newSessionBus() *sessionBus {
+	return &sessionBus{sessions: make(map[sessionKey]*sessionRecord)}
+}
+
+func (b *sessionBus) getOrCreate(key sessionKey) *sessionRecord {
+	rec, ok := b.sessions[key]
+	if !ok {
+		rec = &sessionRecord{created: time.Now()}
+		b.sessions[key] = rec
+	}
+	return rec
+}
+
+func (b *sessionBus) publishTCP(key sessionKey, rtt time.Duration) {
+	b.Lock()
+	defer b.Unlock()
+	rec := b.getOrCreate(key)
+	rec.tcpRTT = rtt
+	rec.haveTCP = true
+}
+
+// sessionsTotal and sessionsWithTCP back the /metrics endpoint.
+var (
+	sessionsTotal   uint64
+	sessionsWithTCP uint64
+)
+
+// sessionSummary is one consolidated record correlating a session's
+// TCP-layer RTT with its application-layer RTT statistics.
+type sessionSummary struct {
+	SessionID   string `json:"session_id"`
+	ClientIP    string `json:"client_ip"`
+	TCPRTTUs    int64  `json:"tcp_rtt_us,omitempty"`
+	AppMinUs    int64  `json:"app_min_us"`
+	AppMedianUs int64  `json:"app_median_us"`
+	AppJitterUs int64  `json:"app_jitter_us"`
+	NumPings    int    `json:"num_pings"`
+}
+
+// flush consolidates the TCP-layer RTT (if any) published for key with the
+// given application-layer samples, appends one JSON line to
+// results/latency_sessions.jsonl, and forgets the session.
+func (b *sessionBus) flush(key sessionKey, appLayer []time.Duration) {
+	b.Lock()
+	rec, ok := b.sessions[key]
+	delete(b.sessions, key)
+	b.Unlock()
+	if !ok {
+		rec = &sessionRecord{created: time.Now()}
+	}
+
+	atomic.AddUint64(&sessionsTotal, 1)
+	if rec.haveTCP {
+		atomic.AddUint64(&sessionsWithTCP, 1)
+	}
+
+	sorted := append([]time.Duration(nil), appLayer...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	summary := sessionSummary{
+		SessionID: key.ip + ":" + strconv.Itoa(int(key.port)),
+		ClientIP:  key.ip,
+		NumPings:  len(sorted),
+	}
+	if rec.haveTCP {
+		summary.TCPRTTUs = rec.tcpRTT.Microseconds()
+	}
+	if len(sorted) > 0 {
+		summary.AppMinUs = sorted[0].Microseconds()
+		summary.AppMedianUs = sorted[len(sorted)/2].Microseconds()
+		// jitter is defined over consecutive samples in arrival order, so it
+		// must run on appLayer, not the sorted copy used for min/median.
+		summary.AppJitterUs = jitter(appLayer).Microseconds()
+	}
+
+	writeSessionJSON(summary)
+}
+
+// jitter approximates the RFC 3550, section A.8, jitter estimate: the mean
+// absolute difference between consecutive samples.
+func jitter(ds []time.Duration) time.Duration {
+	if len(ds) < 2 {
+		return 0
+	}
+	var sum time.Duration
+	for i := 1; i < len(ds); i++ {
+		d := ds[i] - ds[i-1]
+		if d < 0 {
+			d = -d
+		}
+		sum += d
+	}
+	return sum / time.Duration(len(ds)-1)
+}
+
+// writeSessionJSON appends the session summary as one JSON line to
+// results/latency_sessions.jsonl.
+func writeSessionJSON(s sessionSummary) {
+	if err := os.MkdirAll("results", 0755); err != nil {
+		log.Printf("Failed to create results directory: %v", err)
+		return
+	}
+	fd, err := os.OpenFile(latencyResultsFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Printf("Failed to open %s: %v", latencyResultsFile, err)
+		return
+	}
+	defer fd.Close()
+
+	enc := json.NewEncoder(fd)
+	if err := enc.Encode(s); err != nil {
+		log.Printf("Failed to encode session summary: %v", err)
+	}
+}
@@ -0,0 +1,16 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+// metricsHandler exposes the session counters in Prometheus's text exposition
+// format, for operators who want to scrape latencysvc alongside the other
+// measurement tools in this repo.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintf(w, "latencysvc_sessions_total %d\n", atomic.LoadUint64(&sessionsTotal))
+	fmt.Fprintf(w, "latencysvc_sessions_with_tcp_rtt_total %d\n", atomic.LoadUint64(&sessionsWithTCP))
+}
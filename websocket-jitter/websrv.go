@@ -2,14 +2,18 @@ package main
 
 import (
 	"bytes"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"sort"
+	"sync"
 	"text/template"
 	"time"
 
+	"github.com/brave/zerotrace"
 	"github.com/gorilla/websocket"
 )
 
@@ -18,8 +22,13 @@ const (
 	// trip time to the client.
 	numAppLayerPings = 10000
 	bindAddr         = ":8443"
+	wsEndpointPath   = "/ws"
 )
 
+// bus correlates each session's zerotrace-measured TCP RTT with the
+// application-layer RTTs collected over its WebSocket connection.
+var bus = newSessionBus()
+
 func mean(ms []time.Duration) time.Duration {
 	var t time.Duration
 
@@ -102,6 +111,10 @@ func webSocketHandler(w http.ResponseWriter, r *http.Request) {
 
 	calcStats(ms)
 	writeStats(ms)
+
+	if key, ok := sessionKeyFromAddr(c.RemoteAddr().String()); ok {
+		bus.flush(key, ms)
+	}
 }
 
 func indexHandler(w http.ResponseWriter, r *http.Request) {
@@ -111,7 +124,7 @@ func indexHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	endpoint := "wss://127.0.0.1:8443/websocket"
+	endpoint := "wss://127.0.0.1:8443" + wsEndpointPath
 	buf := new(bytes.Buffer)
 	if err := t.Execute(buf, struct {
 		WebSocketEndpoint string
@@ -126,13 +139,87 @@ func indexHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprint(w, string(buf.Bytes()))
 }
 
+// ztListener wraps a plain TCP listener and hands back connections that run
+// their own zerotrace traceroute, the same way ripe-atlas/tls-service does,
+// so the TCP-layer RTT is known before the WebSocket handler ever sees the
+// connection.  Accept itself never runs the traceroute: http.ServeTLS calls
+// Accept serially from a single accept loop, so a slow peer there would
+// block every other incoming connection behind it.
+type ztListener struct {
+	net.Listener
+	zt  *zerotrace.ZeroTrace
+	bus *sessionBus
+}
+
+func (l *ztListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &ztConn{Conn: conn, zt: l.zt, bus: l.bus}, nil
+}
+
+// ztConn defers its zerotrace traceroute to the first Read or Write.
+// net/http's TLS listener wraps whatever Accept returns in a *tls.Conn that
+// itself defers the handshake to first use, and that first use happens on
+// the connection's own serving goroutine rather than the accept loop -- so
+// by running the traceroute from there too, we keep it strictly before any
+// TLS handshake bytes are consumed without blocking other connections.
+type ztConn struct {
+	net.Conn
+	zt   *zerotrace.ZeroTrace
+	bus  *sessionBus
+	once sync.Once
+}
+
+func (c *ztConn) traceOnce() {
+	c.once.Do(func() {
+		rtt, err := c.zt.CalcRTT(c.Conn)
+		if err != nil {
+			log.Printf("zerotrace measurement for %s failed: %v", c.Conn.RemoteAddr(), err)
+			return
+		}
+		if key, ok := sessionKeyFromAddr(c.Conn.RemoteAddr().String()); ok {
+			c.bus.publishTCP(key, rtt)
+		}
+	})
+}
+
+func (c *ztConn) Read(b []byte) (int, error) {
+	c.traceOnce()
+	return c.Conn.Read(b)
+}
+
+func (c *ztConn) Write(b []byte) (int, error) {
+	c.traceOnce()
+	return c.Conn.Write(b)
+}
+
 func main() {
+	var iface string
+	flag.StringVar(&iface, "iface", "", "The networking interface to use zerotrace for.")
+	flag.Parse()
+
 	http.HandleFunc("/", indexHandler)
-	http.HandleFunc("/websocket", webSocketHandler)
+	http.HandleFunc(wsEndpointPath, webSocketHandler)
+	http.HandleFunc("/metrics", metricsHandler)
+
+	ln, err := net.Listen("tcp", bindAddr)
+	if err != nil {
+		log.Fatalf("Failed to listen on %s: %v", bindAddr, err)
+	}
+
+	ztConfig := zerotrace.NewDefaultConfig()
+	ztConfig.Interface = iface
+	zt := zerotrace.NewZeroTrace(ztConfig)
+	if err := zt.Start(); err != nil {
+		log.Fatalf("Error starting zerotrace: %v", err)
+	}
+
 	log.Printf("Starting Web server at %s.", bindAddr)
 	// Generate a self-signed certificate for localhost by running:
 	// openssl req -nodes -x509 -newkey rsa:4096 \
 	//   -keyout key.pem -out cert.pem -sha256 -days 365 \
 	//   -subj "/C=US/ST=Oregon/L=Portland/O=Company Name/OU=Org/CN=192.168.1.3"
-	log.Fatal(http.ListenAndServeTLS(bindAddr, "cert.pem", "key.pem", nil))
+	log.Fatal(http.ServeTLS(&ztListener{Listener: ln, zt: zt, bus: bus}, "cert.pem", "key.pem", nil))
 }